@@ -0,0 +1,159 @@
+package lurker
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+)
+
+// DefaultNonceSize ...
+var DefaultNonceSize = 32
+
+var errAuthRequired = errors.New("authorization was required")
+var errAuthFailed = errors.New("authorization was failed")
+var errAuthID = errors.New("id was not authorized")
+
+// Authorization answers the nonce of the server with the mac of the key of the id
+type Authorization struct {
+	ID  string `json:"id"`
+	MAC []byte `json:"mac"`
+}
+
+// authorizer keeps the authorization state of a connector, a nil authorizer authorizes everything
+type authorizer struct {
+	keys  map[string]string
+	lock  sync.Mutex
+	nonce []byte
+	id    string
+}
+
+func newAuthorizer(keys map[string]string) *authorizer {
+	if len(keys) == 0 {
+		return nil
+	}
+	return &authorizer{
+		keys: keys,
+	}
+}
+
+// authMAC is the hmac-sha256 of the nonce and the id
+func authMAC(key string, nonce []byte, id string) []byte {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(nonce)
+	h.Write([]byte(id))
+	return h.Sum(nil)
+}
+
+// authorized reports whether the handshake may run, only a ping is allowed before the authorization
+func (a *authorizer) authorized(ht HandshakeType) bool {
+	if a == nil || ht == HandshakeTypePing || ht == HandshakeAuthorization {
+		return true
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.id != ""
+}
+
+// challenge returns a new nonce, the former authorization is dropped
+func (a *authorizer) challenge() ([]byte, error) {
+	if a == nil {
+		return nil, nil
+	}
+	nonce := make([]byte, DefaultNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	a.lock.Lock()
+	a.nonce, a.id = nonce, ""
+	a.lock.Unlock()
+	return nonce, nil
+}
+
+// verify checks the answer to the last nonce, which can not be answered twice
+func (a *authorizer) verify(data []byte) error {
+	if a == nil {
+		return nil
+	}
+	var r Authorization
+	if err := json.Unmarshal(data, &r); err != nil {
+		return err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	nonce := a.nonce
+	a.nonce = nil
+	key, b := a.keys[r.ID]
+	if !b || nonce == nil || !hmac.Equal(r.MAC, authMAC(key, nonce, r.ID)) {
+		return errAuthFailed
+	}
+	a.id = r.ID
+	return nil
+}
+
+// check reports whether the id claimed in a handshake was the authorized one
+func (a *authorizer) check(id string) error {
+	if a == nil {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.id != id {
+		return errAuthID
+	}
+	return nil
+}
+
+// authorize handles the two steps of the authorization on the server side:
+// an empty request is answered with a nonce, the answer with the result
+func authorize(c Connector, auth *authorizer, data []byte) error {
+	if len(data) == 0 {
+		nonce, err := auth.challenge()
+		if err != nil {
+			_ = c.Reply(HandshakeStatusFailed, nil)
+			return err
+		}
+		//an empty nonce tells the source that no authorization was required
+		return c.Reply(HandshakeStatusSuccess, nonce)
+	}
+	if err := auth.verify(data); err != nil {
+		log.Debugw("debug|authorize|verify", "error", err)
+		_ = c.Reply(HandshakeStatusFailed, []byte(errAuthFailed.Error()))
+		return errAuthFailed
+	}
+	return c.Reply(HandshakeStatusSuccess, []byte("Authorized"))
+}
+
+// SetAuthKey sets the pre-shared key of the service id, the server is authorized to before each handshake
+func (s *source) SetAuthKey(key string) {
+	s.authKey = key
+}
+
+// authorize answers the nonce of the server when a key was set
+func (s *source) authorize(conn net.Conn) error {
+	if s.authKey == "" {
+		return nil
+	}
+	if s.service.ID == "" {
+		s.service.ID = GlobalID
+	}
+	resp, err := handshake(s, conn, HandshakeAuthorization, nil)
+	if err != nil {
+		return err
+	}
+	if len(resp.Data) == 0 {
+		return nil
+	}
+	req, err := json.Marshal(Authorization{
+		ID:  s.service.ID,
+		MAC: authMAC(s.authKey, resp.Data, s.service.ID),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = handshake(s, conn, HandshakeAuthorization, req)
+	return err
+}
@@ -0,0 +1,60 @@
+package lurker
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/portmapping/lurker/common"
+)
+
+// TestSource_SetAuthKey ...
+func TestSource_SetAuthKey(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.NAT = false
+	cfg.TCP = freeTCPPort(t)
+	cfg.UDP = freeUDPPort(t)
+	cfg.AuthKeys = map[string]string{
+		"alice": "alice key",
+	}
+	l := New(cfg)
+	l.RegisterListener("tcp", NewTCPListener(cfg))
+	l.RegisterListener("udp", NewUDPListener(cfg))
+	c, err := l.Listen(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	go func() {
+		for range c {
+		}
+	}()
+
+	tests := []struct {
+		name    string
+		id      string
+		key     string
+		wantErr bool
+	}{
+		{"authorized", "alice", "alice key", false},
+		{"wrong key", "alice", "bob key", true},
+		{"unknown id", "bob", "alice key", true},
+		{"skipped", "alice", "", true},
+	}
+	for _, network := range []string{"tcp", "udp"} {
+		port := cfg.TCP
+		if network == "udp" {
+			port = cfg.UDP
+		}
+		addr := *common.ParseSourceAddr(network, net.IPv4(127, 0, 0, 1), port)
+		for _, tt := range tests {
+			t.Run(network+" "+tt.name, func(t *testing.T) {
+				s := NewSource(Service{ID: tt.id}, addr)
+				s.SetAuthKey(tt.key)
+				if err := s.Connect(); (err != nil) != tt.wantErr {
+					t.Fatal("wrong error", err)
+				}
+			})
+		}
+	}
+}
@@ -6,27 +6,54 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/portmapping/lurker/proxy"
+	"github.com/portmapping/lurker/stun"
 )
 
 // Proxy ...
 type Proxy struct {
-	Type string `json:"type"`
-	Nat  bool   `json:"nat"`
-	Port int    `json:"port"`
-	Name string `json:"name"`
-	Pass string `json:"pass"`
+	Type string `json:"type" yaml:"type" toml:"type"`
+	Nat  bool   `json:"nat" yaml:"nat" toml:"nat"`
+	Port int    `json:"port" yaml:"port" toml:"port"`
+	Name string `json:"name" yaml:"name" toml:"name"`
+	Pass string `json:"pass" yaml:"pass" toml:"pass"`
+	//Htpasswd is the path of a file of bcrypt users, it is reloaded when changed
+	Htpasswd string `json:"htpasswd" yaml:"htpasswd" toml:"htpasswd"`
+	//Rules are the access control of the destinations, the first matching rule decides a request
+	//and the ones matched by none are decided by Action, allow or deny
+	Rules  []proxy.Rule `json:"rules" yaml:"rules" toml:"rules"`
+	Action string       `json:"action" yaml:"action" toml:"action"`
+	//Rate limits each connection and UserRate all connections of a user, in bytes per second and 0 is unlimited
+	Rate     int64 `json:"rate" yaml:"rate" toml:"rate"`
+	UserRate int64 `json:"user_rate" yaml:"user_rate" toml:"user_rate"`
 }
 
 // Config ...
 type Config struct {
-	TCP         int
-	UDP         int
-	NAT         bool
-	UseProxy    bool
-	Proxy       []Proxy
-	UseSecret   bool
-	Certificate string
-	secret      *tls.Config
+	TCP           int      `json:"tcp" yaml:"tcp" toml:"tcp"`
+	UDP           int      `json:"udp" yaml:"udp" toml:"udp"`
+	KCP           int      `json:"kcp" yaml:"kcp" toml:"kcp"`
+	NAT           bool     `json:"nat" yaml:"nat" toml:"nat"`
+	STUN          []string `json:"stun" yaml:"stun" toml:"stun"`
+	AlternateIP   string   `json:"alternate_ip" yaml:"alternate_ip" toml:"alternate_ip"`
+	AlternatePort int      `json:"alternate_port" yaml:"alternate_port" toml:"alternate_port"`
+	UseProxy      bool     `json:"use_proxy" yaml:"use_proxy" toml:"use_proxy"`
+	Proxy         []Proxy  `json:"proxy" yaml:"proxy" toml:"proxy"`
+	UseSecret     bool     `json:"use_secret" yaml:"use_secret" toml:"use_secret"`
+	Certificate   string   `json:"certificate" yaml:"certificate" toml:"certificate"`
+	Key           string   `json:"key" yaml:"key" toml:"key"`
+	CA            string   `json:"ca" yaml:"ca" toml:"ca"`
+	VerifyClient  bool     `json:"verify_client" yaml:"verify_client" toml:"verify_client"`
+	//AuthKeys are the pre-shared keys of the service ids, the listeners require the authorization when set
+	AuthKeys map[string]string `json:"auth_keys" yaml:"auth_keys" toml:"auth_keys"`
+	//NoiseKey is the hex private key binding the connect id, peer connections are encrypted with it
+	NoiseKey string `json:"noise_key" yaml:"noise_key" toml:"noise_key"`
+	//Upstreams are the proxies the outbound tcp connections are chained through, the first of the
+	//Routes matching a destination selects one and Upstream is used for the unmatched ones
+	Upstreams []Upstream    `json:"upstreams" yaml:"upstreams" toml:"upstreams"`
+	Routes    []proxy.Route `json:"routes" yaml:"routes" toml:"routes"`
+	Upstream  string        `json:"upstream" yaml:"upstream" toml:"upstream"`
+	secret    *tls.Config
 }
 
 // DefaultTimeout ...
@@ -35,12 +62,18 @@ var DefaultTimeout = 60 * time.Second
 // DefaultConnectionTimeout ...
 var DefaultConnectionTimeout = 15 * time.Second
 
+// DefaultShutdownTimeout is the time the connectors are waited for when the listen context is done
+var DefaultShutdownTimeout = 10 * time.Second
+
 // DefaultTCP ...
 var DefaultTCP = 46666
 
 // DefaultUDP ...
 var DefaultUDP = 47777
 
+// DefaultKCP ...
+var DefaultKCP = 48888
+
 // DefaultLocalTCPAddr ...
 var DefaultLocalTCPAddr = &net.TCPAddr{
 	IP:   net.IPv4zero,
@@ -70,7 +103,9 @@ func DefaultConfig() *Config {
 	return &Config{
 		TCP:      DefaultTCP,
 		UDP:      DefaultUDP,
+		KCP:      DefaultKCP,
 		NAT:      true,
+		STUN:     append([]string(nil), stun.DefaultServers...),
 		UseProxy: true,
 		Proxy: []Proxy{
 			{
@@ -82,6 +117,8 @@ func DefaultConfig() *Config {
 		},
 		UseSecret:   false,
 		Certificate: "",
+		Key:         "",
+		CA:          "",
 		secret:      nil,
 	}
 }
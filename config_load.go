@@ -0,0 +1,236 @@
+package lurker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/portmapping/lurker/proxy"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix is the prefix of the environment variables overriding the config
+var EnvPrefix = "LURKER_"
+
+type envOverride struct {
+	name string
+	set  func(cfg *Config, v string) error
+}
+
+var envOverrides = []envOverride{
+	{"TCP", func(cfg *Config, v string) (err error) {
+		cfg.TCP, err = strconv.Atoi(v)
+		return err
+	}},
+	{"UDP", func(cfg *Config, v string) (err error) {
+		cfg.UDP, err = strconv.Atoi(v)
+		return err
+	}},
+	{"KCP", func(cfg *Config, v string) (err error) {
+		cfg.KCP, err = strconv.Atoi(v)
+		return err
+	}},
+	{"NAT", func(cfg *Config, v string) (err error) {
+		cfg.NAT, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"STUN", func(cfg *Config, v string) error {
+		cfg.STUN = splitList(v)
+		return nil
+	}},
+	{"ALTERNATE_IP", func(cfg *Config, v string) error {
+		cfg.AlternateIP = v
+		return nil
+	}},
+	{"ALTERNATE_PORT", func(cfg *Config, v string) (err error) {
+		cfg.AlternatePort, err = strconv.Atoi(v)
+		return err
+	}},
+	{"USE_PROXY", func(cfg *Config, v string) (err error) {
+		cfg.UseProxy, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"USE_SECRET", func(cfg *Config, v string) (err error) {
+		cfg.UseSecret, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"CERTIFICATE", func(cfg *Config, v string) error {
+		cfg.Certificate = v
+		return nil
+	}},
+	{"KEY", func(cfg *Config, v string) error {
+		cfg.Key = v
+		return nil
+	}},
+	{"CA", func(cfg *Config, v string) error {
+		cfg.CA = v
+		return nil
+	}},
+	{"VERIFY_CLIENT", func(cfg *Config, v string) (err error) {
+		cfg.VerifyClient, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"NOISE_KEY", func(cfg *Config, v string) error {
+		cfg.NoiseKey = v
+		return nil
+	}},
+}
+
+// LoadConfig reads the config file over DefaultConfig, the format is chosen by the extension:
+// .json, .yaml, .yml or .toml. The LURKER_ environment variables override the file, the
+// result is validated and the secret is loaded. An empty path loads the defaults with the overrides only
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := decodeConfig(filepath.Ext(path), data, cfg); err != nil {
+			return nil, fmt.Errorf("config %v was wrong: %w", path, err)
+		}
+	}
+	if err := cfg.LoadEnv(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.UseSecret {
+		if _, err := cfg.Secret(); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// decodeConfig refuses the unknown keys in every format, a misspelled key is not ignored silently
+func decodeConfig(ext string, data []byte, cfg *Config) error {
+	switch strings.ToLower(ext) {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		return dec.Decode(cfg)
+	case ".yaml", ".yml":
+		return yaml.UnmarshalStrict(data, cfg)
+	case ".toml":
+		md, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return err
+		}
+		if keys := md.Undecoded(); len(keys) > 0 {
+			return fmt.Errorf("keys %v were unknown", keys)
+		}
+		return nil
+	}
+	return fmt.Errorf("config format %v was not supported", ext)
+}
+
+// LoadEnv overrides the config with the environment variables set, e.g. LURKER_TCP=16004
+func (c *Config) LoadEnv() error {
+	for _, o := range envOverrides {
+		v, b := os.LookupEnv(EnvPrefix + o.name)
+		if !b {
+			continue
+		}
+		if err := o.set(c, v); err != nil {
+			return fmt.Errorf("environment %v%v was wrong: %w", EnvPrefix, o.name, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks the ports, the proxy types and the certificate paths
+func (c *Config) Validate() error {
+	ports := []struct {
+		name string
+		port int
+	}{
+		{"tcp", c.TCP},
+		{"udp", c.UDP},
+		{"kcp", c.KCP},
+	}
+	for _, p := range ports {
+		if !validPort(p.port) {
+			return fmt.Errorf("%v port %v was out of range", p.name, p.port)
+		}
+	}
+	if c.AlternatePort != 0 && !validPort(c.AlternatePort) {
+		return fmt.Errorf("alternate port %v was out of range", c.AlternatePort)
+	}
+	if c.AlternateIP != "" && net.ParseIP(c.AlternateIP) == nil {
+		return fmt.Errorf("alternate ip %v was wrong", c.AlternateIP)
+	}
+	for _, p := range c.Proxy {
+		protocol, id := proxyExit(p.Type)
+		if !proxy.Supported(protocol) || strings.HasSuffix(p.Type, "@") && id == "" {
+			return fmt.Errorf("proxy type %v was not supported", p.Type)
+		}
+		if !validPort(p.Port) {
+			return fmt.Errorf("proxy port %v was out of range", p.Port)
+		}
+		if protocol == proxy.HTTPS && c.Certificate == "" {
+			return fmt.Errorf("certificate was required by the https proxy")
+		}
+		if _, err := proxy.NewRules(p.Rules, p.Action); err != nil {
+			return fmt.Errorf("proxy rules were wrong: %w", err)
+		}
+		if p.Rate < 0 || p.UserRate < 0 {
+			return fmt.Errorf("proxy rate was negative")
+		}
+		if p.Htpasswd != "" {
+			if _, err := os.Stat(p.Htpasswd); err != nil {
+				return fmt.Errorf("htpasswd was not found: %w", err)
+			}
+		}
+	}
+	if c.UseSecret && c.Certificate == "" {
+		return fmt.Errorf("certificate was required by use_secret")
+	}
+	for _, path := range []string{c.Certificate, c.Key, c.CA} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("certificate was not found: %w", err)
+		}
+	}
+	for id, key := range c.AuthKeys {
+		if key == "" {
+			return fmt.Errorf("auth key of %v was empty", id)
+		}
+	}
+	if c.VerifyClient && c.CA == "" {
+		return fmt.Errorf("ca was required by verify_client")
+	}
+	if c.NoiseKey != "" {
+		if _, err := ParseNoiseKey(c.NoiseKey); err != nil {
+			return fmt.Errorf("noise key was wrong: %w", err)
+		}
+	}
+	if _, err := c.Dialer(); err != nil {
+		return fmt.Errorf("upstreams were wrong: %w", err)
+	}
+	return nil
+}
+
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+func splitList(v string) []string {
+	var list []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
@@ -0,0 +1,73 @@
+package lurker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestLoadConfig ...
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lurker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{"config.json", `{"tcp":16004,"udp":16005,"stun":["127.0.0.1:3478"],"proxy":[{"type":"socks5","port":10081}]}`, false},
+		{"config.yaml", "tcp: 16004\nudp: 16005\nstun:\n  - 127.0.0.1:3478\nproxy:\n  - type: socks5\n    port: 10081\n", false},
+		{"config.toml", "tcp = 16004\nudp = 16005\nstun = [\"127.0.0.1:3478\"]\n[[proxy]]\ntype = \"socks5\"\nport = 10081\n", false},
+		{"config.ini", "tcp=16004", true},
+		{"port.json", `{"tcp":70000}`, true},
+		{"proxy.json", `{"proxy":[{"type":"ftp","port":10081}]}`, true},
+		{"secret.json", `{"use_secret":true,"certificate":"not_found.pem"}`, true},
+		{"upstream.json", `{"upstreams":[{"name":"corp","type":"http","addr":"127.0.0.1:3128"}],"routes":[{"upstream":"other"}]}`, true},
+		{"unknown.json", `{"tcp":16004,"tcp_port":16004}`, true},
+		{"unknown.yaml", "tcp: 16004\ntcp_port: 16004\n", true},
+		{"unknown.toml", "tcp = 16004\ntcp_port = 16004\n", true},
+		{"rules.yaml", "proxy:\n  - type: socks5\n    port: 10081\n    rules:\n      - action: deny\n        hosts: [10.0.0.0/33]\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if err := ioutil.WriteFile(path, []byte(tt.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := LoadConfig(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatal("wrong error", err)
+			}
+			if tt.wantErr {
+				return
+			}
+			if cfg.TCP != 16004 || cfg.UDP != 16005 || cfg.KCP != DefaultKCP ||
+				len(cfg.STUN) != 1 || len(cfg.Proxy) != 1 || cfg.Proxy[0].Port != 10081 {
+				t.Fatal("wrong config", cfg)
+			}
+		})
+	}
+}
+
+// TestConfig_LoadEnv ...
+func TestConfig_LoadEnv(t *testing.T) {
+	os.Setenv("LURKER_UDP", "16005")
+	os.Setenv("LURKER_STUN", "127.0.0.1:3478, 127.0.0.2:3478")
+	defer os.Unsetenv("LURKER_UDP")
+	defer os.Unsetenv("LURKER_STUN")
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TCP != DefaultTCP || cfg.UDP != 16005 || len(cfg.STUN) != 2 || cfg.STUN[1] != "127.0.0.2:3478" {
+		t.Fatal("wrong config", cfg)
+	}
+	os.Setenv("LURKER_UDP", "udp")
+	if _, err := LoadConfig(""); err == nil {
+		t.Fatal("wrong env was loaded")
+	}
+}
@@ -1,6 +1,10 @@
 package lurker
 
-import "github.com/portmapping/lurker/common"
+import (
+	"sync"
+
+	"github.com/portmapping/lurker/common"
+)
 
 // Connector ...
 type Connector interface {
@@ -16,6 +20,7 @@ type ConnectorListener interface {
 	RegisterCallback(cb ConnectorCallback)
 	ID(f func(string))
 	Addr(f func(addr common.Addr))
+	Closed(f func())
 }
 
 // ConnectorCallback ...
@@ -30,6 +35,9 @@ func receive(connector Connector) (err error) {
 	header, err := connector.Header()
 	if err != nil {
 		log.Debugw("connector get header", "error", err)
+		if err == errConnectorIdle || err == errConnectorClosed {
+			return err
+		}
 		e := connector.Reply(HandshakeStatusFailed, nil)
 		if e != nil {
 			log.Debugw("connector response", "error", e)
@@ -39,3 +47,78 @@ func receive(connector Connector) (err error) {
 
 	return connector.Do(header.Type)
 }
+
+// connectorListener keeps the callbacks registered on a connector
+type connectorListener struct {
+	mu   sync.RWMutex
+	id   func(id string)
+	addr func(addr common.Addr)
+	cb   ConnectorCallback
+	done func()
+}
+
+// ID ...
+func (l *connectorListener) ID(f func(string)) {
+	l.mu.Lock()
+	l.id = f
+	l.mu.Unlock()
+}
+
+// Addr ...
+func (l *connectorListener) Addr(f func(addr common.Addr)) {
+	l.mu.Lock()
+	l.addr = f
+	l.mu.Unlock()
+}
+
+// Closed ...
+func (l *connectorListener) Closed(f func()) {
+	l.mu.Lock()
+	l.done = f
+	l.mu.Unlock()
+}
+
+// RegisterCallback ...
+func (l *connectorListener) RegisterCallback(cb ConnectorCallback) {
+	l.mu.Lock()
+	l.cb = cb
+	l.mu.Unlock()
+}
+
+func (l *connectorListener) callID(id string) {
+	l.mu.RLock()
+	f := l.id
+	l.mu.RUnlock()
+	if f != nil {
+		f(id)
+	}
+}
+
+func (l *connectorListener) callAddr(addr common.Addr) {
+	l.mu.RLock()
+	f := l.addr
+	l.mu.RUnlock()
+	if f != nil {
+		f(addr)
+	}
+}
+
+func (l *connectorListener) callback(rt HandshakeType, data []byte) bool {
+	l.mu.RLock()
+	f := l.cb
+	l.mu.RUnlock()
+	if f == nil {
+		return false
+	}
+	f(rt, data)
+	return true
+}
+
+func (l *connectorListener) callClosed() {
+	l.mu.RLock()
+	f := l.done
+	l.mu.RUnlock()
+	if f != nil {
+		f()
+	}
+}
@@ -1,10 +1,9 @@
 package main
 
 import (
+	"context"
 	"github.com/portmapping/lurker"
-	"github.com/portmapping/lurker/common"
 	"github.com/spf13/cobra"
-	"net"
 )
 
 func cmdCheck() *cobra.Command {
@@ -21,14 +20,17 @@ func cmdCheck() *cobra.Command {
 	cmd := &cobra.Command{
 		Use: "check",
 		Run: func(cmd *cobra.Command, args []string) {
-			addrs, i := common.ParseAddr(addr)
-			localAddr := net.IPv4zero
-			ispAddr := net.IPv4zero
-
-			cfg := lurker.DefaultConfig()
-			var err error
+			cfg, set, err := loadConfig(cmd)
+			if err != nil {
+				panic(err)
+			}
+			s, err := newSource(cfg, id, network, addr)
+			if err != nil {
+				panic(err)
+			}
 			mport := bindPort
-			if !test && proxy != "" {
+			if set("proxy") || set("pport") || set("pname") || set("ppass") {
+				cfg.UseProxy = proxy != ""
 				cfg.Proxy = []lurker.Proxy{
 					{
 						Type: proxy,
@@ -38,23 +40,15 @@ func cmdCheck() *cobra.Command {
 						Pass: proxyPass,
 					},
 				}
+			}
+			if !test && cfg.UseProxy && len(cfg.Proxy) > 0 {
 				l := lurker.New(cfg)
-				mport, err = lurker.RegisterLocalProxy(l, cfg)
+				mport, err = lurker.RegisterLocalProxy(l, cfg, s)
 				if err != nil {
 					panic(err)
 				}
-				go l.ListenOnMonitor()
+				go l.ListenOnMonitor(context.Background())
 			}
-
-			s := lurker.NewSource(lurker.Service{
-				ID:    id,
-				ISP:   ispAddr,
-				Local: localAddr,
-			}, common.Addr{
-				Protocol: network,
-				IP:       addrs,
-				Port:     i,
-			})
 			if bindPort != 0 {
 				mapping, err := lurker.Mapping("tcp", bindPort)
 				if err != nil {
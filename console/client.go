@@ -1,11 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"net"
 
 	"github.com/portmapping/lurker"
-	"github.com/portmapping/lurker/common"
+	"github.com/portmapping/lurker/stun"
 	"github.com/spf13/cobra"
 )
 
@@ -19,18 +19,25 @@ func cmdClient() *cobra.Command {
 	var proxyPass string
 	var bindPort int
 	var id string
+	var peer string
 	var test bool
+	var detect bool
+	var stunServers []string
 	cmd := &cobra.Command{
 		Use: "client",
 		Run: func(cmd *cobra.Command, args []string) {
-			addrs, i := common.ParseAddr(addr)
-			localAddr := net.IPv4zero
-			ispAddr := net.IPv4zero
-
-			cfg := lurker.DefaultConfig()
-			var err error
+			cfg, set, err := loadConfig(cmd)
+			if err != nil {
+				panic(err)
+			}
+			s, err := newSource(cfg, id, network, addr)
+			if err != nil {
+				panic(err)
+			}
+			fmt.Println("your connect id:", s.Service().ID)
 			mport := bindPort
-			if !test && proxy != "" {
+			if set("proxy") || set("pport") || set("pname") || set("ppass") {
+				cfg.UseProxy = proxy != ""
 				cfg.Proxy = []lurker.Proxy{
 					{
 						Type: proxy,
@@ -40,24 +47,15 @@ func cmdClient() *cobra.Command {
 						Pass: proxyPass,
 					},
 				}
+			}
+			if !test && cfg.UseProxy && len(cfg.Proxy) > 0 {
 				l := lurker.New(cfg)
-				mport, err = lurker.RegisterLocalProxy(l, cfg)
+				mport, err = lurker.RegisterLocalProxy(l, cfg, s)
 				if err != nil {
 					panic(err)
 				}
-				go l.ListenOnMonitor()
+				go l.ListenOnMonitor(context.Background())
 			}
-
-			fmt.Println("your connect id:", id)
-			s := lurker.NewSource(lurker.Service{
-				ID:    id,
-				ISP:   ispAddr,
-				Local: localAddr,
-			}, common.Addr{
-				Protocol: network,
-				IP:       addrs,
-				Port:     i,
-			})
 			if bindPort != 0 {
 				mapping, err := lurker.Mapping("tcp", bindPort)
 				if err != nil {
@@ -65,23 +63,60 @@ func cmdClient() *cobra.Command {
 				}
 				mport = mapping.ExtPort()
 			}
-			s.SetMappingPort("tcp", mport)
-			err = s.Connect()
+			s.SetMappingPort(network, mport)
+			if set("stun") {
+				cfg.STUN = stunServers
+			}
+			if detect {
+				r, err := s.Detect(cfg.STUN...)
+				if err != nil {
+					fmt.Println("detect failed:", err)
+				} else {
+					fmt.Println("nat detected:", r)
+				}
+			}
+			if peer != "" {
+				conn, err := s.Dial(peer)
+				if err != nil {
+					panic(err)
+				}
+				fmt.Println("connected", conn.LocalAddr().String(), "to", conn.RemoteAddr().String())
+				conn.Close()
+				return
+			}
+			peers, err := s.Register()
 			if err != nil {
 				panic(err)
 			}
+			go func() {
+				for p := range peers {
+					fmt.Println("peer", p.ID, "address is", p.Addr.String())
+					go func(p lurker.Peer) {
+						conn, err := s.Accept(p)
+						if err != nil {
+							fmt.Println("accept failed:", err)
+							return
+						}
+						fmt.Println("accepted", conn.LocalAddr().String(), "to", conn.RemoteAddr().String())
+						conn.Close()
+					}(p)
+				}
+			}()
 			waitForSignal()
 		},
 	}
 	cmd.Flags().StringVarP(&addr, "addr", "a", "127.0.0.1:16004", "default 127.0.0.1:16004")
 	cmd.Flags().StringVarP(&network, "network", "n", "tcp", "")
 	cmd.Flags().IntVarP(&local, "local", "l", 16004, "handle local mapping port")
-	cmd.Flags().StringVarP(&proxy, "proxy", "p", "socks5", "locak proxy")
+	cmd.Flags().StringVarP(&proxy, "proxy", "p", "socks5", "local proxy, socks5@<id> exits from the network of the peer")
 	cmd.Flags().StringVarP(&proxyName, "pname", "", "", "local proxy port")
 	cmd.Flags().StringVarP(&proxyPass, "ppass", "", "", "local proxy port")
 	cmd.Flags().IntVarP(&proxyPort, "pport", "", 10080, "local proxy port")
 	cmd.Flags().IntVarP(&bindPort, "bind", "b", 0, "set bind port")
 	cmd.Flags().BoolVarP(&test, "test", "t", false, "set test flag")
 	cmd.Flags().StringVarP(&id, "id", "", lurker.GlobalID, "set the connect id")
+	cmd.Flags().BoolVarP(&detect, "detect", "", false, "detect the nat behavior before connecting")
+	cmd.Flags().StringSliceVarP(&stunServers, "stun", "", stun.DefaultServers, "stun servers used to detect the nat behavior")
+	cmd.Flags().StringVarP(&peer, "peer", "", "", "request the address of the peer with this connect id")
 	return cmd
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/portmapping/lurker"
+	"github.com/spf13/cobra"
+)
+
+func cmdExpose() *cobra.Command {
+	var addr string
+	var network string
+	var id string
+	var local string
+	var name string
+	var protocol string
+	var exit bool
+	var allow []string
+	cmd := &cobra.Command{
+		Use:   "expose",
+		Short: "expose a local service to the peers",
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, _, err := loadConfig(cmd)
+			if err != nil {
+				panic(err)
+			}
+			s, err := newSource(cfg, id, network, addr)
+			if err != nil {
+				panic(err)
+			}
+			fmt.Println("your connect id:", s.Service().ID)
+			e := lurker.NewExposer(s)
+			if name != "" {
+				e.Expose(lurker.ForwardService{
+					Name:    name,
+					Network: protocol,
+					Addr:    local,
+				})
+				fmt.Println("expose", protocol, local, "as", name)
+			}
+			e.Allow(allow...)
+			if exit {
+				e.EnableExit()
+				fmt.Println("exit enabled")
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				waitForSignal()
+				cancel()
+			}()
+			if err := e.Serve(ctx); err != nil {
+				panic(err)
+			}
+		},
+	}
+	cmd.Flags().StringVarP(&addr, "addr", "a", "127.0.0.1:16004", "address of the server")
+	cmd.Flags().StringVarP(&network, "network", "n", "tcp", "network connecting the server")
+	cmd.Flags().StringVarP(&id, "id", "", lurker.GlobalID, "set the connect id")
+	cmd.Flags().StringVarP(&local, "local", "l", "127.0.0.1:22", "address of the local service")
+	cmd.Flags().StringVarP(&name, "name", "", "ssh", "name of the service")
+	cmd.Flags().StringVarP(&protocol, "protocol", "", "tcp", "network of the service, tcp or udp")
+	cmd.Flags().BoolVarP(&exit, "exit", "", false, "let the proxies of the peers exit from this network")
+	cmd.Flags().StringSliceVarP(&allow, "allow", "", nil, "connect ids of the peers allowed to connect, required by the exit")
+	return cmd
+}
+
+func cmdForward() *cobra.Command {
+	var addr string
+	var network string
+	var id string
+	var peer string
+	var service string
+	var listen string
+	var protocol string
+	cmd := &cobra.Command{
+		Use:   "forward",
+		Short: "forward a local address to a service exposed by a peer",
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, _, err := loadConfig(cmd)
+			if err != nil {
+				panic(err)
+			}
+			s, err := newSource(cfg, id, network, addr)
+			if err != nil {
+				panic(err)
+			}
+			fmt.Println("your connect id:", s.Service().ID)
+			f := lurker.NewForwarder(s, peer)
+			defer f.Close()
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				waitForSignal()
+				cancel()
+			}()
+			fmt.Println("forward", protocol, listen, "to", service, "of", peer)
+			if err := f.Forward(ctx, protocol, service, listen); err != nil {
+				panic(err)
+			}
+		},
+	}
+	cmd.Flags().StringVarP(&addr, "addr", "a", "127.0.0.1:16004", "address of the server")
+	cmd.Flags().StringVarP(&network, "network", "n", "tcp", "network connecting the server")
+	cmd.Flags().StringVarP(&id, "id", "", lurker.GlobalID, "set the connect id")
+	cmd.Flags().StringVarP(&peer, "peer", "", "", "connect id of the exposing peer")
+	cmd.Flags().StringVarP(&service, "service", "", "ssh", "name of the service")
+	cmd.Flags().StringVarP(&listen, "listen", "l", "127.0.0.1:2222", "local address forwarded to the service")
+	cmd.Flags().StringVarP(&protocol, "protocol", "", "tcp", "network of the service, tcp or udp")
+	return cmd
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/portmapping/lurker/proxy"
+	"github.com/spf13/cobra"
+)
+
+func cmdHtpasswd() *cobra.Command {
+	var policy string
+	cmd := &cobra.Command{
+		Use:   "htpasswd <name> <pass>",
+		Short: "generate a bcrypt line of the htpasswd file of the proxy users",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			hash, err := proxy.HashPassword(args[1])
+			if err != nil {
+				panic(err)
+			}
+			line := args[0] + ":" + hash
+			if policy != "" {
+				line += ":" + policy
+			}
+			fmt.Println(line)
+		},
+	}
+	cmd.Flags().StringVarP(&policy, "policy", "", "", "policy of the user as key=value,key=value")
+	return cmd
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/signal"
 
+	"github.com/portmapping/lurker"
 	"github.com/spf13/cobra"
 )
 
@@ -21,15 +22,31 @@ var rootCmd = &cobra.Command{
 	},
 }
 
+var configPath string
+
+// loadConfig loads the file of --config, the returned set reports whether a flag should be applied:
+// without a file every flag is applied, with a file only the flags given on the command line
+func loadConfig(cmd *cobra.Command) (*lurker.Config, func(name string) bool, error) {
+	cfg, err := lurker.LoadConfig(configPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	set := func(name string) bool {
+		return configPath == "" || cmd.Flags().Changed(name)
+	}
+	return cfg, set, nil
+}
+
 func waitForSignal() {
-	sigs := make(chan os.Signal)
+	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, os.Interrupt)
 	<-sigs
 }
 
 func main() {
 	zap.InitZapSugar()
-	rootCmd.AddCommand(cmdServer(), cmdClient())
+	rootCmd.PersistentFlags().StringVarP(&configPath, "config", "c", "", "config file of json, yaml or toml")
+	rootCmd.AddCommand(cmdServer(), cmdClient(), cmdExpose(), cmdForward(), cmdNoiseKey(), cmdHtpasswd())
 	fmt.Println("Current Verstion:", Version)
 	if err := rootCmd.Execute(); err != nil {
 		return
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/portmapping/lurker"
+	"github.com/spf13/cobra"
+)
+
+func cmdNoiseKey() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "noise-key",
+		Short: "generate the noise key binding a connect id",
+		Run: func(cmd *cobra.Command, args []string) {
+			key, err := lurker.GenerateNoiseKey()
+			if err != nil {
+				panic(err)
+			}
+			fmt.Println("noise key:", hex.EncodeToString(key.Private))
+			fmt.Println("your connect id:", lurker.NoiseID(key.Public))
+		},
+	}
+	return cmd
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/portmapping/lurker"
@@ -9,29 +10,60 @@ import (
 
 func cmdServer() *cobra.Command {
 	tcp := 0
-	//udp := 0
+	udp := 0
+	kcp := 0
+	altIP := ""
+	altPort := 0
 	nat := false
 	cmd := &cobra.Command{
 		Use: "server",
 		Run: func(cmd *cobra.Command, args []string) {
-			cfg := lurker.DefaultConfig()
-			cfg.TCP = tcp
-			//cfg.UDP = udp
-			cfg.NAT = nat
+			cfg, set, err := loadConfig(cmd)
+			if err != nil {
+				panic(err)
+			}
+			if set("tcp") {
+				cfg.TCP = tcp
+			}
+			if set("udp") {
+				cfg.UDP = udp
+			}
+			if set("kcp") {
+				cfg.KCP = kcp
+			}
+			if set("alt-ip") {
+				cfg.AlternateIP = altIP
+			}
+			if set("alt-port") {
+				cfg.AlternatePort = altPort
+			}
+			if set("nat") {
+				cfg.NAT = nat
+			}
 			l := lurker.New(cfg)
 			t := lurker.NewTCPListener(cfg)
 			l.RegisterListener("tcp", t)
-			err := l.ListenOnMonitor()
+			u := lurker.NewUDPListener(cfg)
+			l.RegisterListener("udp", u)
+			k := lurker.NewKCPListener(cfg)
+			l.RegisterListener("kcp", k)
+			fmt.Println("your connect id:", lurker.GlobalID)
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				waitForSignal()
+				cancel()
+			}()
+			err = l.ListenOnMonitor(ctx)
 			if err != nil {
 				panic(err)
-				return
 			}
-			fmt.Println("your connect id:", lurker.GlobalID)
-			waitForSignal()
 		},
 	}
 	cmd.Flags().IntVarP(&tcp, "tcp", "t", 16004, "handle tcp port")
-	//cmd.Flags().IntVarP(&udp, "udp", "u", 16005, "handle udp port")
+	cmd.Flags().IntVarP(&udp, "udp", "u", 16005, "handle udp port")
+	cmd.Flags().IntVarP(&kcp, "kcp", "k", 16006, "handle kcp port")
+	cmd.Flags().StringVarP(&altIP, "alt-ip", "", "", "alternate ip answering the stun change requests")
+	cmd.Flags().IntVarP(&altPort, "alt-port", "", 0, "alternate port answering the stun change requests")
 	cmd.Flags().BoolVarP(&nat, "nat", "n", false, "enable nat")
 	return cmd
 }
@@ -28,7 +28,9 @@ func main() {
 		if err != nil {
 			continue
 		}
-		go px.HandleConnect(accept)
+		if err := px.Connect(accept); err != nil {
+			fmt.Println("connect failed:", err)
+		}
 	}
 
 }
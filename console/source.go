@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+
+	"github.com/portmapping/lurker"
+	"github.com/portmapping/lurker/common"
+)
+
+// newSource returns the source of the server at addr with the keys and the secret of the config,
+// the id is replaced by the one bound to the noise key when the config has one
+func newSource(cfg *lurker.Config, id string, network string, addr string) (lurker.Source, error) {
+	addrs, i := common.ParseAddr(addr)
+	s := lurker.NewSource(lurker.Service{
+		ID:    id,
+		ISP:   net.IPv4zero,
+		Local: net.IPv4zero,
+	}, common.Addr{
+		Protocol: network,
+		IP:       addrs,
+		Port:     i,
+	})
+	if cfg.NoiseKey != "" {
+		key, err := lurker.ParseNoiseKey(cfg.NoiseKey)
+		if err != nil {
+			return nil, err
+		}
+		s.SetNoiseKey(key)
+	}
+	if key, b := cfg.AuthKeys[s.Service().ID]; b {
+		s.SetAuthKey(key)
+	}
+	dialer, err := cfg.Dialer()
+	if err != nil {
+		return nil, err
+	}
+	s.SetDialer(dialer)
+	if cfg.UseSecret {
+		secret, err := cfg.Secret()
+		if err != nil {
+			return nil, err
+		}
+		s.SetSecret(secret)
+	}
+	return s, nil
+}
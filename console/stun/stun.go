@@ -1,9 +1,17 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/portmapping/lurker/stun"
 )
 
 func main() {
-	stun.Support()
+	r, err := stun.Discover(os.Args[1:]...)
+	if err != nil {
+		fmt.Println("discover failed:", err)
+		return
+	}
+	fmt.Println(r)
 }
@@ -0,0 +1,563 @@
+package lurker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/portmapping/lurker/common"
+	"github.com/portmapping/lurker/pool"
+)
+
+// DefaultForwardIdle closes the udp flows without datagrams in both directions
+var DefaultForwardIdle = 2 * time.Minute
+
+// DefaultForwardPending is the number of datagrams a new udp flow queues while its stream is opened,
+// the ones above it are dropped
+var DefaultForwardPending = 16
+
+var errForwardClosed = errors.New("forwarder was closed")
+var errExitNotAllowed = errors.New("exit was enabled without allowed peers")
+
+// ForwardService is a local service exposed to the peers by its name
+type ForwardService struct {
+	Name    string `json:"name"`
+	Network string `json:"network"`
+	Addr    string `json:"addr"`
+}
+
+// ForwardRequest opens a stream of a session to the exposed service,
+// or to the address dialed from the exposing peer when it is an exit
+type ForwardRequest struct {
+	Service string `json:"service"`
+	Network string `json:"network"`
+	Addr    string `json:"addr,omitempty"`
+}
+
+// Exposer serves its local services to the peers connecting through the server of the source
+type Exposer struct {
+	source   Source
+	services sync.Map
+	sessions sync.Map
+	allowed  sync.Map
+	exit     bool
+}
+
+// Forwarder listens locally and forwards every connection to a service exposed by the peer,
+// all of them share one session over the peer connection
+type Forwarder struct {
+	source Source
+	peer   string
+	lock   sync.Mutex
+	sess   Session
+	closed bool
+}
+
+// pipeConn closes both sides when either read ends, the copy of the other direction is ended with it
+type pipeConn struct {
+	net.Conn
+	peer net.Conn
+	once *sync.Once
+}
+
+// NewExposer ...
+func NewExposer(source Source) *Exposer {
+	return &Exposer{
+		source: source,
+	}
+}
+
+// Expose adds or replaces the service
+func (e *Exposer) Expose(service ForwardService) {
+	if service.Network == "" {
+		service.Network = "tcp"
+	}
+	e.services.Store(service.Name, service)
+}
+
+// Allow accepts only the sessions of the peers with the ids, the ids are the ones bound to the keys
+// of the peers by the handshake of the session. Without allowed peers every peer is accepted
+func (e *Exposer) Allow(ids ...string) {
+	for _, id := range ids {
+		e.allowed.Store(id, true)
+	}
+}
+
+// EnableExit lets the peers dial any tcp address from the network of the exposer,
+// the proxies of the peers use it as their exit, Serve refuses it without allowed peers
+func (e *Exposer) EnableExit() {
+	e.exit = true
+}
+
+func (e *Exposer) hasAllowed() bool {
+	has := false
+	e.allowed.Range(func(key, value interface{}) bool {
+		has = true
+		return false
+	})
+	return has
+}
+
+// isAllowed reports whether the session of the peer is accepted,
+// the exit never accepts the peers without an allowed list
+func (e *Exposer) isAllowed(id string) bool {
+	if !e.hasAllowed() {
+		return !e.exit
+	}
+	_, b := e.allowed.Load(id)
+	return b
+}
+
+// Serve registers to the server and accepts the peers until ctx is done
+func (e *Exposer) Serve(ctx context.Context) error {
+	if e.exit && !e.hasAllowed() {
+		return errExitNotAllowed
+	}
+	peers, err := e.source.Register()
+	if err != nil {
+		return err
+	}
+	defer e.sessions.Range(func(key, value interface{}) bool {
+		value.(Session).Close()
+		return true
+	})
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case p, b := <-peers:
+			if !b {
+				return errForwardClosed
+			}
+			go e.accept(p)
+		}
+	}
+}
+
+func (e *Exposer) accept(p Peer) {
+	if !e.isAllowed(p.ID) {
+		log.Warnw("forward peer was not allowed", "id", p.ID)
+		return
+	}
+	sess, err := e.source.AcceptSession(p)
+	if err != nil {
+		log.Debugw("debug|Exposer|AcceptSession", "id", p.ID, "error", err)
+		return
+	}
+	log.Infow("forward session accepted", "id", p.ID)
+	e.sessions.Store(sess, sess)
+	defer e.sessions.Delete(sess)
+	defer sess.Close()
+	for {
+		stream, err := sess.AcceptStream()
+		if err != nil {
+			log.Debugw("debug|Exposer|AcceptStream", "id", p.ID, "error", err)
+			return
+		}
+		go e.handle(stream)
+	}
+}
+
+// handle answers the forward request of the stream and connects it to the service
+func (e *Exposer) handle(stream net.Conn) {
+	reply := func(head HandshakeHead, status HandshakeStatus, msg string) error {
+		resp, err := EncodeHandshakeResponse(head.Version, &HandshakeResponse{
+			Status: status,
+			Data:   []byte(msg),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = stream.Write(resp)
+		return err
+	}
+	head, data, err := ReadHandshake(stream)
+	if err != nil || head.Type != HandshakeTypeForward {
+		log.Debugw("debug|Exposer|ReadHandshake", "type", head.Type, "error", err)
+		stream.Close()
+		return
+	}
+	var r ForwardRequest
+	if err := json.Unmarshal(data, &r); err != nil {
+		_ = reply(head, HandshakeStatusFailed, "wrong forward request")
+		stream.Close()
+		return
+	}
+	service, msg := e.service(r)
+	if msg != "" {
+		_ = reply(head, HandshakeStatusFailed, msg)
+		stream.Close()
+		return
+	}
+	conn, err := net.DialTimeout(service.Network, service.Addr, DefaultConnectionTimeout)
+	if err != nil {
+		log.Debugw("debug|Exposer|Dial", "service", service.Name, "error", err)
+		_ = reply(head, HandshakeStatusFailed, "service was not reachable")
+		stream.Close()
+		return
+	}
+	if err := reply(head, HandshakeStatusSuccess, "Forwarded"); err != nil {
+		conn.Close()
+		stream.Close()
+		return
+	}
+	if common.IsUDP(service.Network) {
+		relayDatagrams(stream, conn)
+		return
+	}
+	pipe(stream, conn)
+}
+
+// service returns the service of the request, or the failure replied
+func (e *Exposer) service(r ForwardRequest) (ForwardService, string) {
+	if r.Addr != "" {
+		if !e.exit || r.Network != "tcp" {
+			return ForwardService{}, "exit was not enabled"
+		}
+		return ForwardService{
+			Name:    "exit",
+			Network: r.Network,
+			Addr:    r.Addr,
+		}, ""
+	}
+	v, b := e.services.Load(r.Service)
+	if !b || v.(ForwardService).Network != r.Network {
+		return ForwardService{}, "service was not exposed"
+	}
+	return v.(ForwardService), ""
+}
+
+// NewForwarder ...
+func NewForwarder(source Source, peer string) *Forwarder {
+	return &Forwarder{
+		source: source,
+		peer:   peer,
+	}
+}
+
+// session returns the session to the peer, a closed one is dialed again
+func (f *Forwarder) session() (Session, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return nil, errForwardClosed
+	}
+	if f.sess != nil && !f.sess.IsClosed() {
+		return f.sess, nil
+	}
+	sess, err := f.source.DialSession(f.peer)
+	if err != nil {
+		return nil, err
+	}
+	f.sess = sess
+	return sess, nil
+}
+
+// Open opens a stream to the service of the peer, udp datagrams are framed with their length on it
+func (f *Forwarder) Open(network string, service string) (net.Conn, error) {
+	return f.open(ForwardRequest{
+		Service: service,
+		Network: network,
+	})
+}
+
+// Dial connects to the address from the network of the peer, which must have enabled the exit.
+// The forwarder is the proxy.Dialer of the proxies exiting through the peer
+func (f *Forwarder) Dial(network string, addr string) (net.Conn, error) {
+	return f.open(ForwardRequest{
+		Network: network,
+		Addr:    addr,
+	})
+}
+
+func (f *Forwarder) open(r ForwardRequest) (net.Conn, error) {
+	sess, err := f.session()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := sess.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	req, err := EncodeHandshake(HandshakeHead{
+		Type: HandshakeTypeForward,
+	}, data)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if err := stream.SetDeadline(time.Now().Add(DefaultConnectionTimeout)); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if _, err := stream.Write(req); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	resp, err := ReadHandshakeResponse(stream)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if resp.Status != HandshakeStatusSuccess {
+		stream.Close()
+		return nil, fmt.Errorf("forward failed: %s", resp.Data)
+	}
+	if err := stream.SetDeadline(time.Time{}); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Forward listens on the local address and forwards to the service of the peer until ctx is done
+func (f *Forwarder) Forward(ctx context.Context, network string, service string, addr string) error {
+	if common.IsUDP(network) {
+		return f.forwardUDP(ctx, service, addr)
+	}
+	return f.forwardTCP(ctx, service, addr)
+}
+
+func (f *Forwarder) forwardTCP(ctx context.Context, service string, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			default:
+			}
+			if e, b := err.(net.Error); b && e.Temporary() {
+				continue
+			}
+			return err
+		}
+		go func() {
+			stream, err := f.Open("tcp", service)
+			if err != nil {
+				log.Debugw("debug|Forwarder|Open", "service", service, "error", err)
+				conn.Close()
+				return
+			}
+			pipe(conn, stream)
+		}()
+	}
+}
+
+// forwardUDP opens a stream for every local address sending to the listener
+func (f *Forwarder) forwardUDP(ctx context.Context, service string, addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	flows := make(map[string]*udpFlow)
+	lock := sync.Mutex{}
+	data := make([]byte, maxByteSize)
+	for {
+		n, from, err := conn.ReadFrom(data)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			default:
+			}
+			return err
+		}
+		key := from.String()
+		lock.Lock()
+		flow, b := flows[key]
+		lock.Unlock()
+		if !b {
+			flow = newUDPFlow(nil, func() {
+				lock.Lock()
+				delete(flows, key)
+				lock.Unlock()
+			})
+			lock.Lock()
+			flows[key] = flow
+			lock.Unlock()
+			//the stream is opened aside, so a slow session does not hold up the other flows
+			go func(flow *udpFlow, from net.Addr) {
+				stream, err := f.Open("udp", service)
+				if err != nil {
+					log.Debugw("debug|Forwarder|Open", "service", service, "error", err)
+					flow.close()
+					return
+				}
+				flow.start(stream, func(b []byte) error {
+					_, err := conn.WriteTo(b, from)
+					return err
+				})
+			}(flow, from)
+		}
+		if err := flow.send(data[:n]); err != nil {
+			log.Debugw("debug|Forwarder|send", "error", err)
+		}
+	}
+}
+
+// Close closes the session, the connections being forwarded are closed with it
+func (f *Forwarder) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closed = true
+	if f.sess != nil {
+		return f.sess.Close()
+	}
+	return nil
+}
+
+// udpFlow carries the datagrams of one udp flow over a stream, it is closed when idle.
+// A flow without stream queues the datagrams until it is started
+type udpFlow struct {
+	lock    sync.Mutex
+	stream  net.Conn
+	pending [][]byte
+	done    bool
+	timer   *time.Timer
+	once    sync.Once
+	closed  func()
+}
+
+func newUDPFlow(stream net.Conn, closed func()) *udpFlow {
+	flow := &udpFlow{
+		stream: stream,
+		closed: closed,
+	}
+	flow.timer = time.AfterFunc(DefaultForwardIdle, flow.close)
+	return flow
+}
+
+func (f *udpFlow) send(b []byte) error {
+	f.timer.Reset(DefaultForwardIdle)
+	f.lock.Lock()
+	stream := f.stream
+	if stream == nil {
+		if len(f.pending) < DefaultForwardPending {
+			f.pending = append(f.pending, append([]byte(nil), b...))
+		}
+		f.lock.Unlock()
+		return nil
+	}
+	f.lock.Unlock()
+	return writeFrame(stream, b)
+}
+
+// start sends the queued datagrams on the opened stream, then passes the ones of the stream to write
+func (f *udpFlow) start(stream net.Conn, write func([]byte) error) {
+	f.lock.Lock()
+	if f.done {
+		f.lock.Unlock()
+		stream.Close()
+		return
+	}
+	for _, b := range f.pending {
+		if err := writeFrame(stream, b); err != nil {
+			log.Debugw("debug|udpFlow|writeFrame", "error", err)
+			break
+		}
+	}
+	f.pending = nil
+	f.stream = stream
+	f.lock.Unlock()
+	f.receive(write)
+}
+
+// receive passes the datagrams of the stream to write until the flow is closed
+func (f *udpFlow) receive(write func([]byte) error) {
+	defer f.close()
+	for {
+		b, err := readFrame(f.stream)
+		if err != nil {
+			return
+		}
+		f.timer.Reset(DefaultForwardIdle)
+		if err := write(b); err != nil {
+			return
+		}
+	}
+}
+
+func (f *udpFlow) close() {
+	f.once.Do(func() {
+		f.timer.Stop()
+		f.lock.Lock()
+		f.done = true
+		stream := f.stream
+		f.lock.Unlock()
+		if stream != nil {
+			stream.Close()
+		}
+		if f.closed != nil {
+			f.closed()
+		}
+	})
+}
+
+// relayDatagrams connects the stream of a udp flow to the connected udp socket of the service
+func relayDatagrams(stream net.Conn, conn net.Conn) {
+	flow := newUDPFlow(stream, func() {
+		conn.Close()
+	})
+	go flow.receive(func(b []byte) error {
+		_, err := conn.Write(b)
+		return err
+	})
+	data := make([]byte, maxByteSize)
+	for {
+		n, err := conn.Read(data)
+		if err != nil {
+			flow.close()
+			return
+		}
+		if err := flow.send(data[:n]); err != nil {
+			flow.close()
+			return
+		}
+	}
+}
+
+// pipe copies both directions with the pool until either side is closed
+func pipe(a net.Conn, b net.Conn) {
+	once := &sync.Once{}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	pool.AddConnections(pool.NewConnection(
+		&pipeConn{Conn: a, peer: b, once: once},
+		&pipeConn{Conn: b, peer: a, once: once},
+		wg,
+	))
+}
+
+// Read ...
+func (c *pipeConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err != nil {
+		c.once.Do(func() {
+			c.Conn.Close()
+			c.peer.Close()
+		})
+	}
+	return n, err
+}
@@ -0,0 +1,234 @@
+package lurker
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	golog "github.com/goextension/log"
+	"github.com/portmapping/lurker/proxy"
+)
+
+func echoTCP(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func echoUDP(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		data := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(data)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(data[:n], from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// exposed returns a forwarder connected to the exposer by a session over a pipe
+func exposed(t *testing.T, e *Exposer) *Forwarder {
+	c1, c2 := net.Pipe()
+	client, err := NewSession(c1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewSession(c2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer server.Close()
+		for {
+			stream, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go e.handle(stream)
+		}
+	}()
+	return &Forwarder{sess: client}
+}
+
+// TestForwarder_Forward ...
+func TestForwarder_Forward(t *testing.T) {
+	e := NewExposer(nil)
+	e.Expose(ForwardService{Name: "echo", Network: "tcp", Addr: echoTCP(t)})
+	e.Expose(ForwardService{Name: "echo-udp", Network: "udp", Addr: echoUDP(t)})
+	f := exposed(t, e)
+	defer f.Close()
+	var err error
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tests := []struct {
+		network string
+		service string
+	}{
+		{"tcp", "echo"},
+		{"udp", "echo-udp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.network, func(t *testing.T) {
+			listen := "127.0.0.1:" + strconv.Itoa(freeTCPPort(t))
+			if tt.network == "udp" {
+				listen = "127.0.0.1:" + strconv.Itoa(freeUDPPort(t))
+			}
+			go f.Forward(ctx, tt.network, tt.service, listen)
+			var conn net.Conn
+			for i := 0; i < 50; i++ {
+				if conn, err = net.Dial(tt.network, listen); err == nil {
+					break
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			got := make([]byte, 5)
+			//the first datagrams may be sent before the udp forwarder is bound
+			for i := 0; i < 10; i++ {
+				_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+				if _, err = conn.Write([]byte("hello")); err == nil {
+					_, err = io.ReadFull(conn, got)
+				}
+				if err == nil || tt.network == "tcp" {
+					break
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+			if err != nil || string(got) != "hello" {
+				t.Fatal("wrong echo", string(got), err)
+			}
+		})
+	}
+
+	if _, err := f.Open("tcp", "unknown"); err == nil {
+		t.Fatal("unknown service was forwarded")
+	}
+}
+
+// TestUDPFlow_Start ...
+func TestUDPFlow_Start(t *testing.T) {
+	flow := newUDPFlow(nil, nil)
+	defer flow.close()
+	//the datagrams of a flow being opened are queued up to the limit
+	for i := 0; i < DefaultForwardPending+1; i++ {
+		if err := flow.send([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream, peer := net.Pipe()
+	defer peer.Close()
+	go flow.start(stream, func(b []byte) error {
+		return nil
+	})
+	_ = peer.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for i := 0; i < DefaultForwardPending; i++ {
+		b, err := readFrame(peer)
+		if err != nil || len(b) != 1 || int(b[0]) != i {
+			t.Fatal("wrong datagram", b, err)
+		}
+	}
+	go func() {
+		_ = flow.send([]byte("next"))
+	}()
+	if b, err := readFrame(peer); err != nil || string(b) != "next" {
+		t.Fatal("wrong datagram", string(b), err)
+	}
+}
+
+// TestForwarder_Dial ...
+func TestForwarder_Dial(t *testing.T) {
+	e := NewExposer(nil)
+	f := exposed(t, e)
+	defer f.Close()
+	echo := echoTCP(t)
+	if _, err := f.Dial("tcp", echo); err == nil {
+		t.Fatal("exit was not enabled")
+	}
+	e.EnableExit()
+	if err := e.Serve(context.Background()); err != errExitNotAllowed {
+		t.Fatal("exit was served without allowed peers", err)
+	}
+	if e.isAllowed("peer") {
+		t.Fatal("exit allowed a peer without the allowed list")
+	}
+	e.Allow("peer")
+	if !e.isAllowed("peer") || e.isAllowed("other") {
+		t.Fatal("wrong allowed peers")
+	}
+
+	//the proxy logs to the global logger registered by the applications
+	golog.Register(log)
+	px, err := proxy.NewWithDialer(proxy.Socks5, nil, proxy.NoAuth(), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := px.ListenOnPort(freeTCPPort(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = px.Connect(conn)
+		}
+	}()
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(l.Addr().(*net.TCPAddr).Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	addr := echo[strings.LastIndex(echo, ":")+1:]
+	port, _ := strconv.Atoi(addr)
+	req := []byte{5, 1, 0, 5, 1, 0, 1, 127, 0, 0, 1, byte(port >> 8), byte(port)}
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp[1] != 0 || resp[3] != 0 {
+		t.Fatal("wrong reply", resp)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "hello" {
+		t.Fatal("wrong echo", string(got), err)
+	}
+}
@@ -3,7 +3,8 @@ module github.com/portmapping/lurker
 go 1.14
 
 require (
-	github.com/ccding/go-stun v0.1.2
+	github.com/BurntSushi/toml v0.3.1
+	github.com/flynn/noise v1.0.0
 	github.com/goextension/log v0.0.2
 	github.com/google/uuid v1.1.1
 	github.com/klauspost/reedsolomon v1.9.6 // indirect
@@ -14,9 +15,10 @@ require (
 	github.com/spf13/cobra v1.0.0
 	github.com/tjfoc/gmsm v1.3.0 // indirect
 	github.com/xtaci/kcp-go/v5 v5.5.12
+	github.com/xtaci/smux v1.5.14
 	go.uber.org/atomic v1.6.0
-	go.uber.org/zap v1.15.0
-	golang.org/x/crypto v0.0.0-20200429183012-4b2356b1ed79 // indirect
-	golang.org/x/net v0.0.0-20200506145744-7e3656a0809f // indirect
+	go.uber.org/zap v1.15.0 // indirect
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
 	golang.org/x/tools v0.0.0-20200117012304-6edc0a871e69 // indirect
+	gopkg.in/yaml.v2 v2.2.7
 )
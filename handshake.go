@@ -1,11 +1,15 @@
 package lurker
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 
 	"github.com/portmapping/lurker/common"
+	"github.com/portmapping/lurker/stun"
 )
 
 // HandshakeStatusSuccess ...
@@ -21,11 +25,25 @@ const (
 	HandshakeTypeAdapter   HandshakeType = 0x03
 	HandshakeAuthorization HandshakeType = 0x04
 	HandshakeReverse       HandshakeType = 0x05
+	HandshakeTypePunch     HandshakeType = 0x06
+	HandshakeTypeRelay     HandshakeType = 0x07
+	HandshakeTypeForward   HandshakeType = 0x08
 )
 
 // HandshakeRequestTypeProxy ...
 const HandshakeRequestTypeProxy RequestType = 0x01
 
+const handshakeHeadSize = 8
+
+// Version1 is spoken by peers which send the payload unframed after the head
+var Version1 = Version{0x00, 0x00, 0x00, 0x01}
+
+// Version2 carries the payload length in the head
+var Version2 = Version{0x00, 0x00, 0x00, 0x02}
+
+// CurrentVersion ...
+var CurrentVersion = Version2
+
 // Version ...
 type Version [4]byte
 
@@ -42,6 +60,7 @@ type RequestType int
 type HandshakeHead struct {
 	Type    HandshakeType `json:"type"`
 	Tunnel  uint8         `json:"tunnel"`
+	Length  uint16        `json:"length"`
 	Version Version       `json:"version"`
 }
 
@@ -69,8 +88,9 @@ type HandshakeRequest struct {
 // HandshakeResponse ...
 type HandshakeResponse struct {
 	//RequestType RequestType     `json:"request_type"`
-	Status HandshakeStatus `json:"status"`
-	Data   []byte          `json:"data"`
+	Status  HandshakeStatus `json:"status"`
+	Data    []byte          `json:"data"`
+	Version Version         `json:"-"`
 }
 
 // JSON ...
@@ -91,6 +111,7 @@ type Service struct {
 	PortUDP     int           `json:"port_udp"`
 	PortTCP     int           `json:"port_tcp"`
 	KeepConnect bool          `json:"keep_connect"`
+	NAT         stun.Behavior `json:"nat"`
 }
 
 // ParseHandshakeJSON ...
@@ -133,9 +154,9 @@ func encodeHandshakeRequestV1(request *HandshakeRequest) ([]byte, error) {
 
 // EncodeHandshakeResponse ...
 func EncodeHandshakeResponse(ver Version, r *HandshakeResponse) ([]byte, error) {
-	switch ver {
-	default:
-
+	switch v := NegotiateVersion(ver); {
+	case v.IsFramed():
+		return encodeHandshakeResponseV2(v, r)
 	}
 	return encodeHandshakeResponseV1(r)
 }
@@ -144,15 +165,106 @@ func encodeHandshakeResponseV1(r *HandshakeResponse) ([]byte, error) {
 	return json.Marshal(r)
 }
 
-func decodeHandshakeResponse(data []byte) (*HandshakeResponse, error) {
-	var resp HandshakeResponse
-	err := json.Unmarshal(data, &resp)
-	if err != nil {
+func encodeHandshakeResponseV2(ver Version, r *HandshakeResponse) ([]byte, error) {
+	if len(r.Data) > maxByteSize {
+		return nil, fmt.Errorf("wrong data size: %d", len(r.Data))
+	}
+	b := make([]byte, handshakeHeadSize, handshakeHeadSize+len(r.Data))
+	b[0] = uint8(r.Status)
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(r.Data)))
+	copy(b[4:8], ver[:])
+	return append(b, r.Data...), nil
+}
+
+// DecodeHandshakeResponse decodes a response received in one datagram
+func DecodeHandshakeResponse(data []byte) (*HandshakeResponse, error) {
+	return ReadHandshakeResponse(bytes.NewReader(data))
+}
+
+// ReadHandshakeResponse reads one response from a stream,
+// peers speaking Version1 answer with a bare json object
+func ReadHandshakeResponse(r io.Reader) (*HandshakeResponse, error) {
+	b := make([]byte, handshakeHeadSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	if b[0] == '{' {
+		var resp HandshakeResponse
+		err := json.NewDecoder(io.MultiReader(bytes.NewReader(b), r)).Decode(&resp)
+		if err != nil {
+			return nil, err
+		}
+		resp.Version = Version1
+		return &resp, nil
+	}
+	resp := HandshakeResponse{
+		Status: HandshakeStatus(b[0]),
+		Data:   make([]byte, binary.BigEndian.Uint16(b[2:4])),
+	}
+	copy(resp.Version[:], b[4:8])
+	if _, err := io.ReadFull(r, resp.Data); err != nil {
 		return nil, err
 	}
 	return &resp, nil
 }
 
+// EncodeHandshake frames data behind the head with CurrentVersion
+func EncodeHandshake(h HandshakeHead, data []byte) ([]byte, error) {
+	if len(data) > maxByteSize {
+		return nil, fmt.Errorf("wrong data size: %d", len(data))
+	}
+	h.Version = CurrentVersion
+	h.Length = uint16(len(data))
+	return append(h.Bytes(), data...), nil
+}
+
+// DecodeHandshake decodes a handshake received in one datagram
+func DecodeHandshake(data []byte) (HandshakeHead, []byte, error) {
+	return ReadHandshake(bytes.NewReader(data))
+}
+
+// ReadHandshake reads the head and the framed payload from a stream,
+// the payload of Version1 peers follows unframed and is left unread
+func ReadHandshake(r io.Reader) (HandshakeHead, []byte, error) {
+	b := make([]byte, handshakeHeadSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return HandshakeHead{}, nil, err
+	}
+	h, err := ParseHandshakeByte(b)
+	if err != nil {
+		return HandshakeHead{}, nil, err
+	}
+	if !h.Version.IsFramed() {
+		return h, nil, nil
+	}
+	data := make([]byte, h.Length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return HandshakeHead{}, nil, err
+	}
+	return h, data, nil
+}
+
+// NegotiateVersion returns the highest version spoken by both sides
+func NegotiateVersion(ver Version) Version {
+	if ver.Less(Version1) {
+		return Version1
+	}
+	if CurrentVersion.Less(ver) {
+		return CurrentVersion
+	}
+	return ver
+}
+
+// Less ...
+func (v Version) Less(ver Version) bool {
+	return bytes.Compare(v[:], ver[:]) < 0
+}
+
+// IsFramed ...
+func (v Version) IsFramed() bool {
+	return !v.Less(Version2)
+}
+
 // JSON ...
 func (h HandshakeHead) JSON() []byte {
 	marshal, err := json.Marshal(h)
@@ -165,11 +277,12 @@ func (h HandshakeHead) JSON() []byte {
 // ParseHandshakeByte ...
 func ParseHandshakeByte(b []byte) (HandshakeHead, error) {
 	var h HandshakeHead
-	if len(b) < 8 {
+	if len(b) < handshakeHeadSize {
 		return h, fmt.Errorf("wrong byte size")
 	}
 	h.Type = HandshakeType(b[0])
 	h.Tunnel = b[1]
+	h.Length = binary.BigEndian.Uint16(b[2:4])
 	h.Version[0] = b[4]
 	h.Version[1] = b[5]
 	h.Version[2] = b[6]
@@ -179,14 +292,11 @@ func ParseHandshakeByte(b []byte) (HandshakeHead, error) {
 
 // Bytes ...
 func (h HandshakeHead) Bytes() []byte {
-	dummy := uint8(0)
-	b := []byte{
-		uint8(h.Type),
-		h.Tunnel,
-		dummy,
-		dummy,
-	}
-	b = append(b, h.Version[:]...)
+	b := make([]byte, handshakeHeadSize)
+	b[0] = uint8(h.Type)
+	b[1] = h.Tunnel
+	binary.BigEndian.PutUint16(b[2:4], h.Length)
+	copy(b[4:8], h.Version[:])
 	return b
 }
 
@@ -0,0 +1,116 @@
+package lurker
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// TestEncodeHandshake ...
+func TestEncodeHandshake(t *testing.T) {
+	req, err := EncodeHandshakeRequest(Service{ID: "handshake"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := EncodeHandshake(HandshakeHead{Type: HandshakeTypeConnect}, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//a stream which returns one byte every read like a segmented tcp connection
+	h, data, err := ReadHandshake(iotest.OneByteReader(bytes.NewReader(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Type != HandshakeTypeConnect || h.Version != CurrentVersion {
+		t.Fatal("wrong head", h)
+	}
+	var r HandshakeRequest
+	service, err := DecodeHandshakeRequest(data, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service.ID != "handshake" {
+		t.Fatal("wrong service", service)
+	}
+}
+
+// TestReadHandshake_Version1 ...
+func TestReadHandshake_Version1(t *testing.T) {
+	head := HandshakeHead{Type: HandshakeTypePing}
+	h, data, err := DecodeHandshake(head.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Type != HandshakeTypePing || h.Version.IsFramed() || data != nil {
+		t.Fatal("wrong head", h, data)
+	}
+}
+
+// TestEncodeHandshakeResponse ...
+func TestEncodeHandshakeResponse(t *testing.T) {
+	r := &HandshakeResponse{
+		Status: HandshakeStatusSuccess,
+		Data:   []byte("PONG"),
+	}
+	for _, ver := range []Version{{}, Version1, Version2, {0xff, 0, 0, 0}} {
+		b, err := EncodeHandshakeResponse(ver, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := ReadHandshakeResponse(iotest.OneByteReader(bytes.NewReader(b)))
+		if err != nil {
+			t.Fatal(ver, err)
+		}
+		if resp.Status != r.Status || string(resp.Data) != "PONG" {
+			t.Fatal("wrong response", ver, resp)
+		}
+		if resp.Version != NegotiateVersion(ver) {
+			t.Fatal("wrong version", ver, resp.Version)
+		}
+	}
+}
+
+// TestTCPConnector_Segmented ...
+func TestTCPConnector_Segmented(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	connector := newTCPConnector(server)
+	ids := make(chan string, 1)
+	connector.ConnectorListener().ID(func(id string) {
+		ids <- id
+	})
+	go receive(connector)
+
+	req, err := EncodeHandshakeRequest(Service{ID: "segmented"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := EncodeHandshake(HandshakeHead{Type: HandshakeTypeConnect}, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for i := range b {
+			if _, err := client.Write(b[i : i+1]); err != nil {
+				return
+			}
+		}
+	}()
+	resp, err := ReadHandshakeResponse(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != HandshakeStatusSuccess {
+		t.Fatal("wrong status", resp.Status)
+	}
+	select {
+	case id := <-ids:
+		if id != "segmented" {
+			t.Fatal("wrong id", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("id was not received")
+	}
+}
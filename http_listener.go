@@ -38,7 +38,7 @@ func (l *httpListener) MappingPort() int {
 func (l *httpListener) Listen(c chan<- Connector) (err error) {
 	tcpAddr := common.LocalTCPAddr(l.port)
 	if l.cfg.UseSecret {
-		l.tcpListener, err = reuse.ListenTLS("tcp", DefaultLocalTCPAddr.String(), l.cfg.secret)
+		l.tcpListener, err = listenTLS(l.cfg, tcpAddr.String())
 	} else {
 		l.tcpListener, err = reuse.ListenTCP("tcp", tcpAddr)
 	}
@@ -60,6 +60,14 @@ func (l *httpListener) Stop() error {
 	return nil
 }
 
+// Shutdown waits for the active requests until ctx is done
+func (l *httpListener) Shutdown(ctx context.Context) error {
+	if l.srv != nil {
+		return l.srv.Shutdown(ctx)
+	}
+	return nil
+}
+
 // NewHTTPListener ...
 func NewHTTPListener(cfg *Config, handler http.Handler) Listener {
 	h := &httpListener{
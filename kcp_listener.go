@@ -0,0 +1,202 @@
+package lurker
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/panjf2000/ants/v2"
+	"github.com/portmapping/lurker/common"
+	"github.com/xtaci/kcp-go/v5"
+)
+
+type kcpListener struct {
+	ctx        context.Context
+	cancel     context.CancelFunc
+	funcPool   *ants.PoolWithFunc
+	port       int
+	listener   *kcp.Listener
+	cfg        *Config
+	subject    Subject
+	connectors connectorSet
+	done       chan struct{}
+	ready      bool
+}
+
+// kcpConn is a kcp session over a punched packet connection
+type kcpConn struct {
+	*kcp.UDPSession
+	conn net.PacketConn
+	done chan struct{}
+	once sync.Once
+}
+
+// NewKCPListener ...
+func NewKCPListener(cfg *Config) Listener {
+	k := &kcpListener{
+		port: cfg.KCP,
+		cfg:  cfg,
+		done: make(chan struct{}),
+	}
+	k.ctx, k.cancel = context.WithCancel(context.TODO())
+	var err error
+	k.funcPool, err = ants.NewPoolWithFunc(ants.DefaultAntsPoolSize, tcpHandler, func(opts *ants.Options) {
+		opts.Nonblocking = false
+	})
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+// IsReady ...
+func (l *kcpListener) IsReady() bool {
+	return l.ready
+}
+
+func (l *kcpListener) setSubject(s Subject) {
+	l.subject = s
+}
+
+// Listen ...
+func (l *kcpListener) Listen(c chan<- Connector) (err error) {
+	udpAddr := common.LocalUDPAddr(l.port)
+	l.listener, err = kcp.ListenWithOptions(udpAddr.String(), nil, 0, 0)
+	if err != nil {
+		return err
+	}
+	log.Infow("listen kcp", "address", udpAddr.String())
+	go l.listenKCP(c)
+	l.ready = true
+	return nil
+}
+
+// Stop ...
+func (l *kcpListener) Stop() error {
+	if l.cancel != nil {
+		l.cancel()
+		l.cancel = nil
+	}
+	if l.listener != nil {
+		return l.listener.Close()
+	}
+	return nil
+}
+
+// Shutdown stops accepting and waits for the connectors being handled until ctx is done
+func (l *kcpListener) Shutdown(ctx context.Context) error {
+	if err := l.Stop(); err != nil {
+		log.Debugw("debug|Shutdown|Stop", "error", err)
+	}
+	if l.listener != nil {
+		<-l.done
+	}
+	defer l.funcPool.Release()
+	return l.connectors.drain(ctx)
+}
+
+func (l *kcpListener) listenKCP(c chan<- Connector) {
+	defer close(l.done)
+	for {
+		select {
+		case <-l.ctx.Done():
+			log.Debugw("context done")
+			return
+		default:
+			sess, err := l.listener.AcceptKCP()
+			if err != nil {
+				log.Debugw("debug|listenKCP|AcceptKCP", "error", err)
+				continue
+			}
+			tuneKCP(sess)
+			log.Debugw("new connector")
+			t := newTCPConnector(sess)
+			t.auth = newAuthorizer(l.cfg.AuthKeys)
+			l.connectors.add(t)
+			t.closed = func() {
+				l.connectors.remove(t)
+			}
+			if l.subject != nil {
+				if err := l.subject.Add(t); err != nil {
+					log.Debugw("debug|subject|Add", "error", err)
+				}
+			}
+			err = l.funcPool.Invoke(t)
+			if err != nil {
+				log.Debugw("debug|funcPool|Invoke", "error", err)
+				t.Close()
+				continue
+			}
+			select {
+			case c <- t:
+			case <-l.ctx.Done():
+				return
+			}
+			log.Debugw("connect done")
+		}
+	}
+}
+
+func tuneKCP(sess *kcp.UDPSession) {
+	sess.SetStreamMode(true)
+	sess.SetWindowSize(128, 128)
+	sess.SetNoDelay(1, 10, 2, 1)
+}
+
+func newKCPConn(conn net.PacketConn, remote net.Addr, conv uint32) (net.Conn, error) {
+	sess, err := kcp.NewConn3(conv, remote, nil, 0, 0, conn)
+	if err != nil {
+		return nil, err
+	}
+	tuneKCP(sess)
+	c := &kcpConn{
+		UDPSession: sess,
+		conn:       conn,
+		done:       make(chan struct{}),
+	}
+	go c.keepAlive(remote)
+	return c, nil
+}
+
+// keepAlive refreshes the nat binding with datagrams too short to be taken as kcp segments
+func (c *kcpConn) keepAlive(remote net.Addr) {
+	ping, err := EncodeHandshake(HandshakeHead{
+		Type: HandshakeTypePing,
+	}, nil)
+	if err != nil {
+		return
+	}
+	t := time.NewTicker(DefaultKeepAlive)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+			if _, err := c.conn.WriteTo(ping, remote); err != nil {
+				log.Debugw("debug|kcpConn|keepAlive", "error", err)
+				return
+			}
+		}
+	}
+}
+
+// Close ...
+func (c *kcpConn) Close() error {
+	err := c.UDPSession.Close()
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+	return err
+}
+
+func dialKCP(addr *net.UDPAddr) (net.Conn, error) {
+	sess, err := kcp.DialWithOptions(addr.String(), nil, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	tuneKCP(sess)
+	return sess, nil
+}
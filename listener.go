@@ -1,6 +1,12 @@
 package lurker
 
-import "github.com/portmapping/lurker/nat"
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/portmapping/lurker/nat"
+)
 
 // Listener ...
 type Listener interface {
@@ -20,3 +26,91 @@ type MappingListener interface {
 	Listener
 	PortMapping
 }
+
+// subjectListener is implemented by listeners whose connectors join the rendezvous
+type subjectListener interface {
+	setSubject(s Subject)
+}
+
+// shutdownListener is implemented by listeners which wait for their connectors on shutdown
+type shutdownListener interface {
+	Shutdown(ctx context.Context) error
+}
+
+// interrupter is a connector whose idle wait for the next handshake can be broken
+type interrupter interface {
+	interrupt()
+}
+
+// aborter is a connector which is closed even when its connection was hijacked by the relay
+type aborter interface {
+	abort()
+}
+
+// connectorSet tracks the live connectors of a listener for the shutdown
+type connectorSet struct {
+	mu         sync.Mutex
+	connectors map[Connector]struct{}
+}
+
+func (s *connectorSet) add(c Connector) {
+	s.mu.Lock()
+	if s.connectors == nil {
+		s.connectors = make(map[Connector]struct{})
+	}
+	s.connectors[c] = struct{}{}
+	s.mu.Unlock()
+}
+
+func (s *connectorSet) remove(c Connector) {
+	s.mu.Lock()
+	delete(s.connectors, c)
+	s.mu.Unlock()
+}
+
+func (s *connectorSet) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.connectors)
+}
+
+func (s *connectorSet) each(f func(c Connector)) {
+	s.mu.Lock()
+	list := make([]Connector, 0, len(s.connectors))
+	for c := range s.connectors {
+		list = append(list, c)
+	}
+	s.mu.Unlock()
+	for _, c := range list {
+		f(c)
+	}
+}
+
+// drain interrupts the connectors waiting for a handshake and waits for the handlers and the relays
+// to finish the others, the connectors left when ctx is done are closed
+func (s *connectorSet) drain(ctx context.Context) error {
+	s.each(func(c Connector) {
+		if v, b := c.(interrupter); b {
+			v.interrupt()
+			return
+		}
+		c.Close()
+	})
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	for s.len() > 0 {
+		select {
+		case <-ctx.Done():
+			s.each(func(c Connector) {
+				if v, b := c.(aborter); b {
+					v.abort()
+					return
+				}
+				c.Close()
+			})
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return nil
+}
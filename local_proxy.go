@@ -2,34 +2,40 @@ package lurker
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"strings"
 
 	"github.com/panjf2000/ants/v2"
 	"github.com/portmapping/lurker/nat"
 	"github.com/portmapping/lurker/proxy"
 )
 
+var errProxyNoSource = errors.New("source was required by the exit peer of the proxy")
+
 type localProxy struct {
 	ctx      context.Context
 	cancel   context.CancelFunc
 	proxyCfg Proxy
 	port     int
 	local    proxy.Proxy
+	listener net.Listener
+	nat      nat.NAT
+	exit     *Forwarder
 	ready    bool
 	protocol string
 	funcPool *ants.PoolWithFunc
 }
 
-// RegisterLocalProxy ...
-func RegisterLocalProxy(l Lurker, cfg *Config) (port int, err error) {
+// RegisterLocalProxy registers the proxies of the config, a type of protocol@id like socks5@<id>
+// connects to the destinations from the network of the peer id, s is the source reaching it
+func RegisterLocalProxy(l Lurker, cfg *Config, s Source) (port int, err error) {
 	for _, p := range cfg.Proxy {
-		a := proxy.NoAuth()
-		if p.Name != "" && p.Pass != "" {
-			a = proxy.Auth{
-				Name: p.Name,
-				Pass: p.Pass,
-			}
+		a, err := proxyAuth(p)
+		if err != nil {
+			return 0, err
 		}
 		var n nat.NAT
 		if p.Nat {
@@ -41,10 +47,32 @@ func RegisterLocalProxy(l Lurker, cfg *Config) (port int, err error) {
 			port = n.ExtPort()
 		}
 
-		lp, err := proxy.New(p.Type, n, a)
+		protocol, id := proxyExit(p.Type)
+		var exit *Forwarder
+		dialer, err := cfg.Dialer()
+		if err != nil {
+			return 0, err
+		}
+		if id != "" {
+			if s == nil {
+				return 0, errProxyNoSource
+			}
+			exit = NewForwarder(s, id)
+			dialer = exit
+		}
+		lp, err := newProxy(cfg, protocol, n, a, dialer)
 		if err != nil {
 			return 0, err
 		}
+		rules, err := proxy.NewRules(p.Rules, p.Action)
+		if err != nil {
+			return 0, err
+		}
+		lp.SetRules(rules)
+		lp.SetLimits(p.Rate, p.UserRate)
+		if p.Nat && len(p.Rules) == 0 && p.Action != proxy.ActionDeny {
+			log.Warnw("proxy mapped to the internet allows every destination", "port", p.Port)
+		}
 		ctx, cFunc := context.WithCancel(context.TODO())
 
 		l.RegisterListener("", &localProxy{
@@ -53,6 +81,8 @@ func RegisterLocalProxy(l Lurker, cfg *Config) (port int, err error) {
 			proxyCfg: p,
 			port:     p.Port,
 			local:    lp,
+			nat:      n,
+			exit:     exit,
 		})
 	}
 
@@ -65,6 +95,7 @@ func (p *localProxy) Listen(c chan<- Connector) (err error) {
 	if err != nil {
 		return err
 	}
+	p.listener = lis
 	log.Infof("listen %v proxy on port: %v", p.proxyCfg.Type, p.port)
 	go p.accept(lis)
 	p.ready = true
@@ -98,9 +129,76 @@ func (p *localProxy) Stop() error {
 		p.cancel()
 		p.cancel = nil
 	}
+	if p.exit != nil {
+		if err := p.exit.Close(); err != nil {
+			log.Debugw("debug|Stop|Close", "error", err)
+		}
+	}
+	if p.listener != nil {
+		return p.listener.Close()
+	}
 	return nil
 }
 
+// proxyAuth returns the authenticator of the users of the htpasswd file and of the name and pass
+func proxyAuth(p Proxy) (proxy.Authenticate, error) {
+	var auths []proxy.Authenticate
+	if p.Htpasswd != "" {
+		h, err := proxy.NewHtpasswd(p.Htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		auths = append(auths, h)
+	}
+	if p.Name != "" && p.Pass != "" {
+		auths = append(auths, proxy.Auth{
+			Name: p.Name,
+			Pass: p.Pass,
+		})
+	}
+	switch len(auths) {
+	case 0:
+		return proxy.NoAuth(), nil
+	case 1:
+		return auths[0], nil
+	}
+	return proxy.ChainAuth(auths...), nil
+}
+
+// newProxy creates the proxy of the protocol, the clients of an https proxy are served
+// with the certificate of the config
+func newProxy(cfg *Config, protocol string, n nat.NAT, a proxy.Authenticate, dialer proxy.Dialer) (proxy.Proxy, error) {
+	if protocol != proxy.HTTPS {
+		return proxy.NewWithDialer(protocol, n, a, dialer)
+	}
+	secret, err := cfg.Secret()
+	if err != nil {
+		return nil, err
+	}
+	//the clients of the proxy are not the peers verified by the ca
+	secret = secret.Clone()
+	secret.ClientAuth = tls.NoClientCert
+	return proxy.NewHTTPS(n, a, dialer, secret)
+}
+
+// proxyExit splits the type into the protocol and the id of the exit peer
+func proxyExit(t string) (protocol string, id string) {
+	if i := strings.Index(t, "@"); i >= 0 {
+		return t[:i], t[i+1:]
+	}
+	return t, ""
+}
+
+// IsSupport ...
+func (p *localProxy) IsSupport() bool {
+	return p.proxyCfg.Nat && p.nat != nil
+}
+
+// NAT ...
+func (p *localProxy) NAT() nat.NAT {
+	return p.nat
+}
+
 // IsReady ...
 func (p *localProxy) IsReady() bool {
 	return p.ready
@@ -1,12 +1,14 @@
 package lurker
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/panjf2000/ants/v2"
 	"sync"
 	"time"
 
+	"github.com/panjf2000/ants/v2"
 	"github.com/portmapping/lurker/common"
 	"github.com/portmapping/lurker/nat"
 )
@@ -22,12 +24,15 @@ type ListenResponse struct {
 
 // Lurker ...
 type Lurker interface {
-	Listen() (c <-chan Connector, err error)
-	ListenOnMonitor() error
+	Listen(ctx context.Context) (c <-chan Connector, err error)
+	ListenOnMonitor(ctx context.Context) error
+	Ready() <-chan struct{}
 	RegisterListener(name string, listener Listener)
 	Listener(name string) (Listener, bool)
 	NetworkNAT(name string) nat.NAT
 	Config() Config
+	Stop() error
+	Shutdown(ctx context.Context) error
 }
 
 type lurker struct {
@@ -36,11 +41,23 @@ type lurker struct {
 	timeout    time.Duration
 	connectors chan Connector
 	pool       *ants.Pool
+	subject    Subject
+	ready      chan struct{}
+	done       chan struct{}
+	closed     sync.Once
+	listening  sync.Once
+}
+
+var errAlreadyListening = errors.New("lurker was listening already")
+
+type listenResult struct {
+	name string
+	err  error
 }
 
-// ListenNoMonitor ...
-func (l *lurker) ListenOnMonitor() error {
-	connectors, err := l.Listen()
+// ListenOnMonitor ...
+func (l *lurker) ListenOnMonitor(ctx context.Context) error {
+	connectors, err := l.Listen(ctx)
 	if err != nil {
 		return err
 	}
@@ -102,6 +119,36 @@ func (l *lurker) Stop() error {
 	return nil
 }
 
+// Shutdown stops every listener and waits for the connectors being handled until ctx is done,
+// then the nat mappings are removed and the connectors channel is closed so that ListenOnMonitor returns
+func (l *lurker) Shutdown(ctx context.Context) (err error) {
+	for name, listener := range l.listeners {
+		var e error
+		if v, b := listener.(shutdownListener); b {
+			e = v.Shutdown(ctx)
+		} else {
+			e = listener.Stop()
+		}
+		if e != nil {
+			log.Debugw("debug|Shutdown|listener", "name", name, "error", e)
+			err = e
+		}
+		if v, b := listener.(NATer); b && v.IsSupport() {
+			if e := v.NAT().StopMapping(); e != nil {
+				log.Debugw("debug|Shutdown|StopMapping", "name", name, "error", e)
+				err = e
+			}
+		}
+	}
+	l.pool.Release()
+	l.closed.Do(func() {
+		close(l.done)
+		close(l.connectors)
+	})
+	log.Infow("lurker shutdown")
+	return err
+}
+
 // New ...
 func New(cfg *Config) Lurker {
 	pool, err := ants.NewPool(5000)
@@ -114,6 +161,9 @@ func New(cfg *Config) Lurker {
 		connectors: make(chan Connector, 5),
 		timeout:    DefaultTimeout,
 		pool:       pool,
+		subject:    NewSubject(),
+		ready:      make(chan struct{}),
+		done:       make(chan struct{}),
 	}
 	return o
 }
@@ -123,54 +173,91 @@ func (l *lurker) RegisterListener(name string, listener Listener) {
 	if name == "" {
 		name = UUID()
 	}
+	if v, b := listener.(subjectListener); b {
+		v.setSubject(l.subject)
+	}
 	l.listeners[name] = listener
 }
 
-func (l *lurker) waitingForReady() {
-	total := len(l.listeners)
-	for {
-		count := 0
-		for _, listener := range l.listeners {
-			if listener.IsReady() {
-				count++
-			}
-		}
-		if count == total {
-			return
-		}
-		time.Sleep(3 * time.Second)
-	}
+// Ready is closed when all listeners are listening
+func (l *lurker) Ready() <-chan struct{} {
+	return l.ready
 }
 
-// Listen ...
-func (l *lurker) Listen() (c <-chan Connector, err error) {
-	defer func() {
-		if e := recover(); e != nil {
-			log.Errorw("listener error found", "error", e)
-			l.Stop()
-		}
-	}()
-
-	var lis []string
+// Listen starts the listeners concurrently and returns when all of them are listening,
+// the first failure is returned at once and every listener is stopped.
+// The listeners are shut down when ctx is done, a lurker is only listened once
+func (l *lurker) Listen(ctx context.Context) (c <-chan Connector, err error) {
+	first := false
+	l.listening.Do(func() {
+		first = true
+	})
+	if !first {
+		return nil, errAlreadyListening
+	}
+	results := make(chan listenResult, len(l.listeners))
 	for name, listener := range l.listeners {
-		lis = append(lis, name)
-		go listener.Listen(l.connectors)
+		go func(name string, listener Listener) {
+			defer func() {
+				if e := recover(); e != nil {
+					log.Errorw("listener error found", "name", name, "error", e)
+					results <- listenResult{name: name, err: fmt.Errorf("listener %v panic: %v", name, e)}
+				}
+			}()
+			results <- listenResult{name: name, err: listener.Listen(l.connectors)}
+		}(name, listener)
+	}
 
-		if l.cfg.NAT {
+	for pending := len(l.listeners); pending > 0; pending-- {
+		select {
+		case r := <-results:
+			if r.err == nil {
+				continue
+			}
+			go l.stopListening(results, pending-1)
+			return nil, fmt.Errorf("listener %v: %w", r.name, r.err)
+		case <-ctx.Done():
+			go l.stopListening(results, pending)
+			return nil, ctx.Err()
+		}
+	}
+
+	if l.cfg.NAT {
+		for _, listener := range l.listeners {
 			if v, b := listener.(MappingListener); b {
 				err := v.NAT().Mapping()
 				if err != nil {
+					l.Stop()
 					return nil, err
 				}
 			}
 		}
-
 	}
-	l.waitingForReady()
-
+	close(l.ready)
+	go func() {
+		select {
+		case <-l.done:
+		case <-ctx.Done():
+			sctx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+			defer cancel()
+			if err := l.Shutdown(sctx); err != nil {
+				log.Debugw("debug|Listen|Shutdown", "error", err)
+			}
+		}
+	}()
 	return l.connectors, nil
 }
 
+// stopListening stops all listeners after the pending ones have returned from Listen
+func (l *lurker) stopListening(results <-chan listenResult, pending int) {
+	for ; pending > 0; pending-- {
+		<-results
+	}
+	if err := l.Stop(); err != nil {
+		log.Debugw("debug|stopListening|Stop", "error", err)
+	}
+}
+
 // JSON ...
 func (r ListenResponse) JSON() []byte {
 	marshal, err := json.Marshal(r)
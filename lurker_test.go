@@ -1,9 +1,13 @@
 package lurker
 
 import (
-	"github.com/portmapping/lurker/common"
+	"context"
+	"net"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/portmapping/lurker/common"
 )
 
 // TestParseAddr ...
@@ -20,3 +24,115 @@ func TestParseAddr(t *testing.T) {
 		t.Fatal(addr.String(), i)
 	}
 }
+
+// TestLurker_Shutdown ...
+func TestLurker_Shutdown(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.NAT = false
+	cfg.TCP = freeTCPPort(t)
+	cfg.UDP = freeUDPPort(t)
+	l := New(cfg)
+	l.RegisterListener("tcp", NewTCPListener(cfg))
+	l.RegisterListener("udp", NewUDPListener(cfg))
+	done := make(chan error, 1)
+	go func() {
+		done <- l.ListenOnMonitor(context.Background())
+	}()
+
+	addr := *common.ParseSourceAddr("tcp", net.IPv4(127, 0, 0, 1), cfg.TCP)
+	var peers <-chan Peer
+	var err error
+	for i := 0; i < 50; i++ {
+		if peers, err = NewSource(Service{ID: "shutdown"}, addr).Register(); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := l.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("ListenOnMonitor was not returned")
+	}
+	select {
+	case _, b := <-peers:
+		if b {
+			t.Fatal("registered connection was not closed")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("registered connection was not closed")
+	}
+
+	tcp, err := net.ListenTCP("tcp", common.LocalTCPAddr(cfg.TCP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp.Close()
+	udp, err := net.ListenUDP("udp", common.LocalUDPAddr(cfg.UDP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp.Close()
+}
+
+// TestLurker_Listen ...
+func TestLurker_Listen(t *testing.T) {
+	used, err := net.ListenTCP("tcp", common.LocalTCPAddr(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer used.Close()
+	cfg := DefaultConfig()
+	cfg.NAT = false
+	cfg.TCP = used.Addr().(*net.TCPAddr).Port
+	cfg.UDP = freeUDPPort(t)
+	l := New(cfg)
+	l.RegisterListener("tcp", NewTCPListener(cfg))
+	l.RegisterListener("udp", NewUDPListener(cfg))
+	start := time.Now()
+	if _, err := l.Listen(context.Background()); err == nil {
+		t.Fatal("used port was listened")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("bind failure was not reported at once")
+	}
+
+	cfg = DefaultConfig()
+	cfg.NAT = false
+	cfg.TCP = freeTCPPort(t)
+	l = New(cfg)
+	l.RegisterListener("tcp", NewTCPListener(cfg))
+	ctx, cancel := context.WithCancel(context.Background())
+	c, err := l.Listen(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-l.Ready():
+	default:
+		t.Fatal("ready was not signaled")
+	}
+	if _, err := l.Listen(ctx); err == nil {
+		t.Fatal("lurker was listened twice")
+	}
+	cancel()
+	select {
+	case _, b := <-c:
+		if b {
+			t.Fatal("wrong connector")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("connectors was not closed")
+	}
+}
@@ -0,0 +1,83 @@
+package lurker
+
+import (
+	"net"
+
+	"github.com/xtaci/smux"
+)
+
+// DefaultMuxConfig is the smux config of the sessions, version 2 has the flow control of each stream
+var DefaultMuxConfig = func() *smux.Config {
+	cfg := smux.DefaultConfig()
+	cfg.Version = 2
+	return cfg
+}()
+
+// Session multiplexes the streams of many forwarded connections over one peer connection
+type Session interface {
+	OpenStream() (net.Conn, error)
+	AcceptStream() (net.Conn, error)
+	NumStreams() int
+	IsClosed() bool
+	Close() error
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+type muxSession struct {
+	*smux.Session
+}
+
+// NewSession starts a session over conn, one side of the connection must be the client,
+// the peer dialing the connection by convention. Closing the session closes conn
+func NewSession(conn net.Conn, client bool) (Session, error) {
+	var sess *smux.Session
+	var err error
+	if client {
+		sess, err = smux.Client(conn, DefaultMuxConfig)
+	} else {
+		sess, err = smux.Server(conn, DefaultMuxConfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &muxSession{Session: sess}, nil
+}
+
+// OpenStream ...
+func (s *muxSession) OpenStream() (net.Conn, error) {
+	return s.Session.OpenStream()
+}
+
+// AcceptStream ...
+func (s *muxSession) AcceptStream() (net.Conn, error) {
+	return s.Session.AcceptStream()
+}
+
+// DialSession dials the peer and starts the client side of a session over the connection
+func (s *source) DialSession(id string) (Session, error) {
+	conn, err := s.Dial(id)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := NewSession(conn, true)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return sess, nil
+}
+
+// AcceptSession accepts the peer and starts the server side of a session over the connection
+func (s *source) AcceptSession(peer Peer) (Session, error) {
+	conn, err := s.Accept(peer)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := NewSession(conn, false)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return sess, nil
+}
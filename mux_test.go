@@ -0,0 +1,91 @@
+package lurker
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// TestNewSession ...
+func TestNewSession(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan Session, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		sess, err := NewSession(conn, false)
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- sess
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewSession(conn, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, b := <-accepted
+	if !b {
+		t.Fatal("session was not accepted")
+	}
+	defer server.Close()
+	go func() {
+		for {
+			stream, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer stream.Close()
+				_, _ = io.Copy(stream, stream)
+			}()
+		}
+	}()
+
+	wg := &sync.WaitGroup{}
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stream, err := client.OpenStream()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer stream.Close()
+			msg := fmt.Sprintf("stream %d", i)
+			if _, err := stream.Write([]byte(msg)); err != nil {
+				errs <- err
+				return
+			}
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(stream, got); err != nil {
+				errs <- err
+				return
+			}
+			if string(got) != msg {
+				errs <- fmt.Errorf("wrong echo: %s", got)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
@@ -2,9 +2,13 @@ package lurker
 
 import (
 	"fmt"
+	"net"
+	"time"
+
 	p2pnat "github.com/libp2p/go-nat"
 	address2 "github.com/portmapping/lurker/common"
 	"github.com/portmapping/lurker/nat"
+	"github.com/portmapping/lurker/stun"
 )
 
 // PublicNetworkTCP ...
@@ -32,10 +36,77 @@ const (
 // SupportType ...
 type SupportType uint64
 
-// Support ...
+// Strategy is the way to reach a peer
+type Strategy int
+
+// Strategy ...
+const (
+	StrategyDirect Strategy = iota
+	StrategyReverse
+	StrategyPunch
+	StrategyRelay
+)
+
+var strategyStr = map[Strategy]string{
+	StrategyDirect:  "direct",
+	StrategyReverse: "reverse",
+	StrategyPunch:   "punch",
+	StrategyRelay:   "relay",
+}
+
+// String ...
+func (s Strategy) String() string {
+	return strategyStr[s]
+}
+
+// Support is the report of the ways a source can be reached
 type Support struct {
 	List [NetworkSupportMax]bool
-	Type SupportType
+	//Latency is the time every finished attempt took and Errors are the failures among them
+	Latency [NetworkSupportMax]time.Duration
+	Errors  [NetworkSupportMax]error
+	Type    SupportType
+	NAT     stun.Result
+	//Network is the index of List which won and Conn is its connection,
+	//Network is NetworkSupportMax when nothing was connected
+	Network int
+	Conn    net.Conn
+	//Chosen is the strategy of Try, punch or relay when nothing was connected
+	Chosen Strategy
+}
+
+func (s *Support) add(network int, latency time.Duration) {
+	s.List[network] = true
+	s.Latency[network] = latency
+	s.Type.Add(SupportType(1) << uint(network))
+}
+
+// Strategy chooses how to reach a peer behind the nat of behavior remote
+func (s Support) Strategy(remote stun.Behavior) Strategy {
+	switch {
+	case s.List[PublicNetworkTCP] || s.List[PublicNetworkUDP]:
+		return StrategyDirect
+	case s.List[ProviderNetworkTCP] || s.List[ProviderNetworkUDP]:
+		return StrategyReverse
+	case punchable(s.NAT.NAT, remote) && punchable(remote, s.NAT.NAT):
+		return StrategyPunch
+	}
+	return StrategyRelay
+}
+
+// punchable reports whether a hole opened from behind a can be entered from behind b,
+// the ports of a symmetric nat can not be predicted by a nat filtering on ports
+func punchable(a, b stun.Behavior) bool {
+	switch a {
+	case stun.BehaviorBlocked:
+		return false
+	case stun.BehaviorSymmetric:
+		switch b {
+		case stun.BehaviorSymmetric, stun.BehaviorPortRestricted, stun.BehaviorFirewall, stun.BehaviorBlocked:
+			return false
+		}
+	}
+	return true
 }
 
 // NATer ...
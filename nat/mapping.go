@@ -115,7 +115,7 @@ func (n *natClient) Remapping() (err error) {
 func (n *natClient) StopMapping() (err error) {
 	if n.nat != nil {
 		n.stop.Store(true)
-		if err := n.nat.DeletePortMapping("tcp", n.port); err != nil {
+		if err := n.nat.DeletePortMapping(n.protocol, n.port); err != nil {
 			return err
 		}
 	}
@@ -3,6 +3,8 @@ package lurker
 import (
 	"fmt"
 	"testing"
+
+	"github.com/portmapping/lurker/stun"
 )
 
 func init() {
@@ -35,3 +37,28 @@ func TestSupportType_Del(t *testing.T) {
 	fmt.Println("support", s)
 	//output:32
 }
+
+// TestSupport_Strategy ...
+func TestSupport_Strategy(t *testing.T) {
+	tests := []struct {
+		local  stun.Behavior
+		remote stun.Behavior
+		public bool
+		want   Strategy
+	}{
+		{stun.BehaviorSymmetric, stun.BehaviorSymmetric, true, StrategyDirect},
+		{stun.BehaviorFullCone, stun.BehaviorSymmetric, false, StrategyPunch},
+		{stun.BehaviorPortRestricted, stun.BehaviorRestricted, false, StrategyPunch},
+		{stun.BehaviorPortRestricted, stun.BehaviorSymmetric, false, StrategyRelay},
+		{stun.BehaviorSymmetric, stun.BehaviorSymmetric, false, StrategyRelay},
+		{stun.BehaviorBlocked, stun.BehaviorFullCone, false, StrategyRelay},
+	}
+	for _, tt := range tests {
+		var s Support
+		s.NAT.NAT = tt.local
+		s.List[PublicNetworkUDP] = tt.public
+		if got := s.Strategy(tt.remote); got != tt.want {
+			t.Fatal("wrong strategy", tt.local, tt.remote, got)
+		}
+	}
+}
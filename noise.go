@@ -0,0 +1,222 @@
+package lurker
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/flynn/noise"
+	"golang.org/x/crypto/curve25519"
+)
+
+// NoisePrologue is mixed into the handshake, peers of other applications can not complete it
+var NoisePrologue = []byte("lurker")
+
+// maxNoisePayload is the plaintext of the largest frame, a frame can not exceed 65535 bytes with the tag
+const maxNoisePayload = 65535 - 16
+
+var noiseSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+
+var errNoiseKey = errors.New("wrong noise key")
+var errNoisePeer = errors.New("static key of the peer was not bound to its id")
+
+// noiseConn encrypts the stream with the cipher states of a finished handshake,
+// every write is sent in frames with a two bytes length
+type noiseConn struct {
+	net.Conn
+	rlock sync.Mutex
+	wlock sync.Mutex
+	send  *noise.CipherState
+	recv  *noise.CipherState
+	buf   []byte
+}
+
+// GenerateNoiseKey returns a new curve25519 static key
+func GenerateNoiseKey() (noise.DHKey, error) {
+	return noise.DH25519.GenerateKeypair(rand.Reader)
+}
+
+// ParseNoiseKey returns the static key of a hex private key
+func ParseNoiseKey(s string) (noise.DHKey, error) {
+	private, err := hex.DecodeString(s)
+	if err != nil {
+		return noise.DHKey{}, err
+	}
+	if len(private) != curve25519.ScalarSize {
+		return noise.DHKey{}, errNoiseKey
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return noise.DHKey{}, err
+	}
+	return noise.DHKey{
+		Private: private,
+		Public:  public,
+	}, nil
+}
+
+// NoiseID is the id of the peer owning the public key, it can not be claimed without the private key
+func NoiseID(public []byte) string {
+	return hex.EncodeToString(public)
+}
+
+// NoiseClient runs the initiator side of the XX handshake on conn, the static key of the responder
+// must be the one of id unless id is empty. The returned connection encrypts everything written
+func NoiseClient(conn net.Conn, key noise.DHKey, id string) (net.Conn, error) {
+	return noiseHandshake(conn, key, id, true)
+}
+
+// NoiseServer runs the responder side of the XX handshake, see NoiseClient
+func NoiseServer(conn net.Conn, key noise.DHKey, id string) (net.Conn, error) {
+	return noiseHandshake(conn, key, id, false)
+}
+
+func noiseHandshake(conn net.Conn, key noise.DHKey, id string, initiator bool) (net.Conn, error) {
+	hs, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:   noiseSuite,
+		Random:        rand.Reader,
+		Pattern:       noise.HandshakeXX,
+		Initiator:     initiator,
+		Prologue:      NoisePrologue,
+		StaticKeypair: key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var cs1, cs2 *noise.CipherState
+	//XX is three messages: -> e, <- e ee s es, -> s se
+	write := initiator
+	for cs1 == nil {
+		if write {
+			var msg []byte
+			msg, cs1, cs2, err = hs.WriteMessage(nil, nil)
+			if err != nil {
+				return nil, err
+			}
+			if err := writeFrame(conn, msg); err != nil {
+				return nil, err
+			}
+		} else {
+			msg, err := readFrame(conn)
+			if err != nil {
+				return nil, err
+			}
+			_, cs1, cs2, err = hs.ReadMessage(nil, msg)
+			if err != nil {
+				return nil, err
+			}
+		}
+		write = !write
+	}
+	if id != "" && NoiseID(hs.PeerStatic()) != id {
+		log.Debugw("debug|noiseHandshake|PeerStatic", "id", id, "static", NoiseID(hs.PeerStatic()))
+		return nil, errNoisePeer
+	}
+	c := &noiseConn{
+		Conn: conn,
+		send: cs1,
+		recv: cs2,
+	}
+	if !initiator {
+		c.send, c.recv = cs2, cs1
+	}
+	return c, nil
+}
+
+// writeFrame writes msg behind its length in two bytes
+func writeFrame(w io.Writer, msg []byte) error {
+	frame := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	copy(frame[2:], msg)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Read ...
+func (c *noiseConn) Read(p []byte) (int, error) {
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+	for len(c.buf) == 0 {
+		msg, err := readFrame(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		c.buf, err = c.recv.Decrypt(msg[:0], nil, msg)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// Write ...
+func (c *noiseConn) Write(p []byte) (int, error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	n := 0
+	for len(p) > 0 {
+		size := len(p)
+		if size > maxNoisePayload {
+			size = maxNoisePayload
+		}
+		msg, err := c.send.Encrypt(nil, nil, p[:size])
+		if err != nil {
+			return n, err
+		}
+		if err := writeFrame(c.Conn, msg); err != nil {
+			return n, err
+		}
+		n += size
+		p = p[size:]
+	}
+	return n, nil
+}
+
+// SetNoiseKey binds the service id to the static key, the connections returned by
+// Dial and Accept are encrypted then and the static key of the peer is checked against its id
+func (s *source) SetNoiseKey(key noise.DHKey) {
+	s.noiseKey = &key
+	s.service.ID = NoiseID(key.Public)
+}
+
+// seal runs the noise handshake on the connection to the peer when a key was set,
+// the dialing side initiates
+func (s *source) seal(conn net.Conn, id string, initiator bool) (net.Conn, error) {
+	if s.noiseKey == nil {
+		return conn, nil
+	}
+	if err := conn.SetDeadline(time.Now().Add(s.timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sealed, err := noiseHandshake(conn, *s.noiseKey, id, initiator)
+	if err != nil {
+		log.Debugw("debug|seal|noiseHandshake", "error", err)
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return sealed, nil
+}
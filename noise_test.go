@@ -0,0 +1,81 @@
+package lurker
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+)
+
+// TestNoiseClient ...
+func TestNoiseClient(t *testing.T) {
+	client, err := GenerateNoiseKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := GenerateNoiseKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ParseNoiseKey(hex.EncodeToString(generated.Private))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(server.Public, generated.Public) {
+		t.Fatal("wrong public key")
+	}
+	tests := []struct {
+		name     string
+		clientID string
+		serverID string
+		wantErr  bool
+	}{
+		{"bound", NoiseID(client.Public), NoiseID(server.Public), false},
+		{"anonymous", "", "", false},
+		{"wrong server", NoiseID(client.Public), NoiseID(client.Public), true},
+		{"wrong client", NoiseID(server.Public), NoiseID(server.Public), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+			accepted := make(chan error, 1)
+			var peer net.Conn
+			go func() {
+				var err error
+				peer, err = NoiseServer(c2, server, tt.clientID)
+				if err != nil {
+					c2.Close()
+				}
+				accepted <- err
+			}()
+			conn, err := NoiseClient(c1, client, tt.serverID)
+			if err != nil {
+				c1.Close()
+			}
+			//the responder checks the initiator after the last message, only one side may fail
+			if e := <-accepted; err == nil {
+				err = e
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatal("wrong error", err)
+			}
+			if tt.wantErr {
+				return
+			}
+			data := bytes.Repeat([]byte("lurker"), 30000)
+			go func() {
+				_, _ = conn.Write(data)
+			}()
+			got := make([]byte, len(data))
+			if _, err := io.ReadFull(peer, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("wrong data")
+			}
+		})
+	}
+}
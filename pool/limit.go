@@ -0,0 +1,143 @@
+package pool
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket of bytes, the tokens are refilled at rate per second up to burst
+type Limiter struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Groups gives the limiter of each group like a user or a peer id, the connections
+// of a group share its rate
+type Groups struct {
+	lock     sync.Mutex
+	rate     int64
+	burst    int64
+	limiters map[string]*groupLimiter
+}
+
+// groupLimiter counts the connections holding the limiter of a group
+type groupLimiter struct {
+	*Limiter
+	refs int
+}
+
+type limitedReader struct {
+	r        io.Reader
+	limiters []*Limiter
+}
+
+// NewLimiter returns a limiter of rate bytes per second, a burst not above 0 is one second of rate.
+// A rate not above 0 is unlimited and returns nil, which is a limiter never waiting
+func NewLimiter(rate int64, burst int64) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return &Limiter{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// WaitN takes n tokens and blocks until the bucket has paid them back
+func (l *Limiter) WaitN(n int) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	wait := time.Duration(0)
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.lock.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Burst ...
+func (l *Limiter) Burst() int {
+	if l == nil {
+		return 0
+	}
+	return int(l.burst)
+}
+
+// NewGroups returns the groups limited to rate bytes per second each
+func NewGroups(rate int64, burst int64) *Groups {
+	return &Groups{
+		rate:     rate,
+		burst:    burst,
+		limiters: make(map[string]*groupLimiter),
+	}
+}
+
+// Get returns the limiter of the group, it is created on the first use and held until Release.
+// nil groups and groups without rate give unlimited nil limiters
+func (g *Groups) Get(name string) *Limiter {
+	if g == nil || g.rate <= 0 {
+		return nil
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	l, b := g.limiters[name]
+	if !b {
+		l = &groupLimiter{Limiter: NewLimiter(g.rate, g.burst)}
+		g.limiters[name] = l
+	}
+	l.refs++
+	return l.Limiter
+}
+
+// Release returns the limiter got for a connection of the group,
+// it is removed when no connection of the group holds it
+func (g *Groups) Release(name string) {
+	if g == nil || g.rate <= 0 {
+		return
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	l, b := g.limiters[name]
+	if !b {
+		return
+	}
+	if l.refs--; l.refs <= 0 {
+		delete(g.limiters, name)
+	}
+}
+
+// Read reads no more than the smallest burst and waits for the bytes read on every limiter
+func (r *limitedReader) Read(p []byte) (int, error) {
+	for _, l := range r.limiters {
+		if b := l.Burst(); b > 0 && len(p) > b {
+			p = p[:b]
+		}
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		for _, l := range r.limiters {
+			l.WaitN(n)
+		}
+	}
+	return n, err
+}
@@ -3,22 +3,48 @@ package pool
 import (
 	"io"
 	"sync"
+	"time"
 
 	"github.com/panjf2000/ants/v2"
 )
 
 type connGroup struct {
-	src io.ReadWriteCloser
-	dst io.ReadWriteCloser
-	wg  *sync.WaitGroup
-	n   *int64
+	src      io.ReadWriteCloser
+	dst      io.ReadWriteCloser
+	wg       *sync.WaitGroup
+	n        *int64
+	limiters []*Limiter
+	reason   *closeReason
+}
+
+// Stats is reported by the callback of a connection when both directions are finished
+type Stats struct {
+	//In is copied from conn2 to conn1, Out from conn1 to conn2
+	In       int64
+	Out      int64
+	Start    time.Time
+	Duration time.Duration
+	//Reason is the first error which ended a direction, nil when both were ended by EOF
+	Reason error
 }
 
 // Connection ...
 type Connection struct {
-	conn1 io.ReadWriteCloser
-	conn2 io.ReadWriteCloser
-	wg    *sync.WaitGroup
+	conn1    io.ReadWriteCloser
+	conn2    io.ReadWriteCloser
+	wg       *sync.WaitGroup
+	limiters []*Limiter
+	callback func(Stats)
+}
+
+// closeWriter is implemented by the connections which can be half closed like tcp
+type closeWriter interface {
+	CloseWrite() error
+}
+
+type closeReason struct {
+	once sync.Once
+	err  error
 }
 
 type pool struct {
@@ -51,11 +77,23 @@ func copyConnGroup(group interface{}) {
 	if !ok {
 		return
 	}
+	var src io.Reader = cg.src
+	if len(cg.limiters) > 0 {
+		src = &limitedReader{r: cg.src, limiters: cg.limiters}
+	}
 	var err error
-	*cg.n, err = io.Copy(cg.dst, cg.src)
+	*cg.n, err = io.Copy(cg.dst, src)
+	if err != nil && cg.reason != nil {
+		cg.reason.once.Do(func() {
+			cg.reason.err = err
+		})
+	}
 	if err != nil {
 		cg.src.Close()
 		cg.dst.Close()
+	} else if cw, b := cg.dst.(closeWriter); b {
+		//the end of the source is passed on, so the other side finishes the opposite direction
+		_ = cw.CloseWrite()
 	}
 	cg.wg.Done()
 }
@@ -69,6 +107,23 @@ func NewConnection(conn1, conn2 io.ReadWriteCloser, wg *sync.WaitGroup) Connecti
 	}
 }
 
+// Limit limits both directions of the connection by every limiter, like the limiter
+// of the connection itself and the one of its group
+func (c Connection) Limit(limiters ...*Limiter) Connection {
+	for _, l := range limiters {
+		if l != nil {
+			c.limiters = append(c.limiters, l)
+		}
+	}
+	return c
+}
+
+// OnDone sets the callback receiving the stats, it is called before the wait group is done
+func (c Connection) OnDone(callback func(Stats)) Connection {
+	c.callback = callback
+	return c
+}
+
 // NewPool ...
 func NewPool() Pool {
 	np, err := ants.NewPool(1000)
@@ -94,14 +149,31 @@ func (p *pool) AddConnections(conn Connection) {
 	})
 }
 func (p *pool) connectsForward(c Connection) {
+	start := time.Now()
 	wg := new(sync.WaitGroup)
 	wg.Add(2)
 	var in, out int64
-	_ = p.copyPool.Invoke(newConnGroup(c.conn1, c.conn2, wg, &in))
-	// outside to mux : incoming
-	_ = p.copyPool.Invoke(newConnGroup(c.conn2, c.conn1, wg, &out))
-	// mux to outside : outgoing
+	reason := &closeReason{}
+	for _, cg := range []connGroup{
+		// outside to mux : incoming
+		newConnGroup(c.conn1, c.conn2, wg, &in),
+		// mux to outside : outgoing
+		newConnGroup(c.conn2, c.conn1, wg, &out),
+	} {
+		cg.limiters = c.limiters
+		cg.reason = reason
+		_ = p.copyPool.Invoke(cg)
+	}
 	wg.Wait()
+	if c.callback != nil {
+		c.callback(Stats{
+			In:       in,
+			Out:      out,
+			Start:    start,
+			Duration: time.Since(start),
+			Reason:   reason.err,
+		})
+	}
 }
 
 // AddConnections ...
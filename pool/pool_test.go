@@ -0,0 +1,59 @@
+package pool
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestPool_Limit ...
+func TestPool_Limit(t *testing.T) {
+	client, conn1 := net.Pipe()
+	conn2, server := net.Pipe()
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	stats := make(chan Stats, 1)
+	group := NewGroups(2000, 500)
+	AddConnections(NewConnection(conn1, conn2, &wg).Limit(nil, group.Get("user")).OnDone(func(st Stats) {
+		stats <- st
+	}))
+	start := time.Now()
+	go func() {
+		_, _ = client.Write(make([]byte, 1500))
+	}()
+	if _, err := io.ReadFull(server, make([]byte, 1500)); err != nil {
+		t.Fatal(err)
+	}
+	//the burst is free and the other 1000 bytes take half a second
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Fatal("transfer was not limited", d)
+	}
+	go func() {
+		_, _ = server.Write([]byte("hello"))
+	}()
+	if _, err := io.ReadFull(client, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	server.Close()
+	wg.Wait()
+	st := <-stats
+	if st.In != 5 || st.Out != 1500 || st.Duration < 400*time.Millisecond || st.Reason != nil {
+		t.Fatal("wrong stats", st.In, st.Out, st.Duration, st.Reason)
+	}
+	//the limiter is shared until the last connection of the group releases it
+	if group.Get("user") != group.Get("user") {
+		t.Fatal("group limiter was not shared")
+	}
+	for i := 0; i < 3; i++ {
+		group.Release("user")
+	}
+	if len(group.limiters) != 0 {
+		t.Fatal("released group limiter was kept")
+	}
+	if NewGroups(0, 0).Get("user") != nil || NewLimiter(0, 0) != nil {
+		t.Fatal("no rate was limited")
+	}
+}
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"crypto/subtle"
 	"errors"
 	"io"
 	"net"
@@ -13,29 +14,66 @@ const (
 	failure      = uint8(1)
 )
 
+var errValidationFailed = errors.New("validation failed")
+
 // Authenticate ...
 type Authenticate interface {
 	NeedAuthenticate() bool
-	Auth(conn net.Conn) error
+	//Auth runs the username/password subnegotiation of rfc1929 on the socks5 connection
+	Auth(conn net.Conn) (*Identity, error)
+	//Validate checks the credentials received outside of the socks5 subnegotiation
+	Validate(name, pass string) (*Identity, error)
+}
+
+// Policy is attached to a user by its authenticator, the requests of the user are routed by it
+type Policy map[string]string
+
+// Get ...
+func (p Policy) Get(key string) string {
+	return p[key]
+}
+
+// Identity is the authenticated user of a proxy connection
+type Identity struct {
+	Name   string
+	Policy Policy
 }
 
+// Anonymous is the identity of the connections of proxies without authentication
+var Anonymous = &Identity{}
+
+// AuthFunc validates the credentials, the returned identity carries the policy of the user
+type AuthFunc func(name, pass string) (*Identity, error)
+
 // Auth ...
 type Auth struct {
-	Name string
-	Pass string
+	Name   string
+	Pass   string
+	Policy Policy
 }
 
 type dummyAuth struct {
 }
 
+type callbackAuth struct {
+	validate AuthFunc
+}
+
+type chainAuth []Authenticate
+
 // NeedAuthenticate ...
 func (d dummyAuth) NeedAuthenticate() bool {
 	return false
 }
 
 // Auth ...
-func (d dummyAuth) Auth(conn net.Conn) error {
-	return nil
+func (d dummyAuth) Auth(conn net.Conn) (*Identity, error) {
+	return Anonymous, nil
+}
+
+// Validate ...
+func (d dummyAuth) Validate(name, pass string) (*Identity, error) {
+	return Anonymous, nil
 }
 
 // NoAuth ...
@@ -48,38 +86,114 @@ func (a Auth) NeedAuthenticate() bool {
 	return true
 }
 
+// Validate compares in constant time so the name and the password can not be guessed by timing
+func (a Auth) Validate(name, pass string) (*Identity, error) {
+	n := subtle.ConstantTimeCompare([]byte(a.Name), []byte(name))
+	p := subtle.ConstantTimeCompare([]byte(a.Pass), []byte(pass))
+	if n&p != 1 {
+		return nil, errValidationFailed
+	}
+	return &Identity{
+		Name:   a.Name,
+		Policy: a.Policy,
+	}, nil
+}
+
+// Auth ...
+func (a Auth) Auth(conn net.Conn) (*Identity, error) {
+	return authUserPass(conn, a.Validate)
+}
+
+// NewCallbackAuth returns an authenticator validating the credentials with f
+func NewCallbackAuth(f AuthFunc) Authenticate {
+	return &callbackAuth{
+		validate: f,
+	}
+}
+
+// NeedAuthenticate ...
+func (c *callbackAuth) NeedAuthenticate() bool {
+	return true
+}
+
+// Validate ...
+func (c *callbackAuth) Validate(name, pass string) (*Identity, error) {
+	id, err := c.validate(name, pass)
+	if err != nil {
+		return nil, err
+	}
+	if id == nil {
+		id = &Identity{Name: name}
+	}
+	return id, nil
+}
+
+// Auth ...
+func (c *callbackAuth) Auth(conn net.Conn) (*Identity, error) {
+	return authUserPass(conn, c.Validate)
+}
+
+// ChainAuth returns an authenticator trying the authenticators in order, the first one
+// accepting the credentials gives the identity
+func ChainAuth(auths ...Authenticate) Authenticate {
+	return chainAuth(auths)
+}
+
+// NeedAuthenticate ...
+func (c chainAuth) NeedAuthenticate() bool {
+	for _, a := range c {
+		if !a.NeedAuthenticate() {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate ...
+func (c chainAuth) Validate(name, pass string) (*Identity, error) {
+	for _, a := range c {
+		if id, err := a.Validate(name, pass); err == nil {
+			return id, nil
+		}
+	}
+	return nil, errValidationFailed
+}
+
 // Auth ...
-func (a Auth) Auth(conn net.Conn) error {
+func (c chainAuth) Auth(conn net.Conn) (*Identity, error) {
+	return authUserPass(conn, c.Validate)
+}
+
+// authUserPass reads the credentials of the subnegotiation and replies the result of validate
+func authUserPass(conn net.Conn, validate AuthFunc) (*Identity, error) {
 	header := []byte{0, 0}
-	if _, err := io.ReadAtLeast(conn, header, 2); err != nil {
-		return err
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
 	}
 	if header[0] != authVersion {
-		return errors.New("the authentication method is not supported")
+		return nil, errors.New("the authentication method is not supported")
 	}
-	nameLen := int(header[1])
-	nameLoad := make([]byte, nameLen)
-	if _, err := io.ReadAtLeast(conn, nameLoad, nameLen); err != nil {
-		return err
+	nameLoad := make([]byte, int(header[1]))
+	if _, err := io.ReadFull(conn, nameLoad); err != nil {
+		return nil, err
 	}
-	if _, err := conn.Read(header[:1]); err != nil {
-		return errors.New("error retrieving password length")
+	if _, err := io.ReadFull(conn, header[:1]); err != nil {
+		return nil, errors.New("error retrieving password length")
 	}
-	passLen := int(header[0])
-	passLoad := make([]byte, passLen)
-	if _, err := io.ReadAtLeast(conn, passLoad, passLen); err != nil {
-		return err
+	passLoad := make([]byte, int(header[0]))
+	if _, err := io.ReadFull(conn, passLoad); err != nil {
+		return nil, err
 	}
 
-	if a.Name == string(nameLoad) && a.Pass == string(passLoad) {
+	id, err := validate(string(nameLoad), string(passLoad))
+	if err == nil {
 		if _, err := conn.Write([]byte{authVersion, success}); err != nil {
-			return err
+			return nil, err
 		}
-		return nil
+		return id, nil
 	}
 	if _, err := conn.Write([]byte{authVersion, failure}); err != nil {
-		return err
+		return nil, err
 	}
-	return errors.New("validation failed")
-
+	return nil, err
 }
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goextension/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DefaultReloadInterval is the least time between two checks of the htpasswd file for changes
+var DefaultReloadInterval = 5 * time.Second
+
+// dummyHash is compared for the unknown users, so they take as long as the known ones
+var dummyHash []byte
+var dummyOnce sync.Once
+
+type htpasswdUser struct {
+	hash   []byte
+	policy Policy
+}
+
+// Htpasswd validates the users of an htpasswd file with bcrypt hashes, each line is
+// name:hash with an optional third field of the policy as key=value,key=value.
+// The file is reloaded when it has changed
+type Htpasswd struct {
+	path    string
+	lock    sync.RWMutex
+	users   map[string]htpasswdUser
+	mod     time.Time
+	checked time.Time
+}
+
+// NewHtpasswd loads the users of the file at path
+func NewHtpasswd(path string) (*Htpasswd, error) {
+	h := &Htpasswd{
+		path: path,
+	}
+	if err := h.Load(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// HashPassword returns the bcrypt hash of an htpasswd line
+func HashPassword(pass string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Load reads the file again, the users are kept when the file is wrong
+func (h *Htpasswd) Load() error {
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	users := make(map[string]htpasswdUser)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.SplitN(text, ":", 3)
+		if len(fields) < 2 || fields[0] == "" {
+			return fmt.Errorf("htpasswd line %v was wrong", line)
+		}
+		if _, err := bcrypt.Cost([]byte(fields[1])); err != nil {
+			return fmt.Errorf("htpasswd line %v was not bcrypt: %w", line, err)
+		}
+		user := htpasswdUser{
+			hash: []byte(fields[1]),
+		}
+		if len(fields) == 3 {
+			user.policy = parsePolicy(fields[2])
+		}
+		users[fields[0]] = user
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	h.lock.Lock()
+	h.users = users
+	h.mod = info.ModTime()
+	h.checked = time.Now()
+	h.lock.Unlock()
+	return nil
+}
+
+// NeedAuthenticate ...
+func (h *Htpasswd) NeedAuthenticate() bool {
+	return true
+}
+
+// Validate ...
+func (h *Htpasswd) Validate(name, pass string) (*Identity, error) {
+	h.reload()
+	h.lock.RLock()
+	user, b := h.users[name]
+	h.lock.RUnlock()
+	if !b {
+		dummyOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("lurker"), bcrypt.DefaultCost)
+		})
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(pass))
+		return nil, errValidationFailed
+	}
+	if bcrypt.CompareHashAndPassword(user.hash, []byte(pass)) != nil {
+		return nil, errValidationFailed
+	}
+	return &Identity{
+		Name:   name,
+		Policy: user.policy,
+	}, nil
+}
+
+// Auth ...
+func (h *Htpasswd) Auth(conn net.Conn) (*Identity, error) {
+	return authUserPass(conn, h.Validate)
+}
+
+// reload loads the file when its modification time has changed since the last load
+func (h *Htpasswd) reload() {
+	h.lock.Lock()
+	if time.Since(h.checked) < DefaultReloadInterval {
+		h.lock.Unlock()
+		return
+	}
+	h.checked = time.Now()
+	mod := h.mod
+	h.lock.Unlock()
+	info, err := os.Stat(h.path)
+	if err != nil || info.ModTime().Equal(mod) {
+		return
+	}
+	if err := h.Load(); err != nil {
+		log.Debugw("debug|reload|Load", "error", err)
+	}
+}
+
+// parsePolicy parses key=value,key=value, a key without value is set to true
+func parsePolicy(s string) Policy {
+	policy := make(Policy)
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		if i := strings.Index(kv, "="); i >= 0 {
+			policy[strings.TrimSpace(kv[:i])] = strings.TrimSpace(kv[i+1:])
+			continue
+		}
+		policy[kv] = "true"
+	}
+	return policy
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestHtpasswd ...
+func TestHtpasswd(t *testing.T) {
+	hash, err := HashPassword("pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "lurker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "htpasswd")
+	write := func(data string) {
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("# users\nname:" + hash + ":group=admin,direct\n")
+	h, err := NewHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := h.Validate("name", "pass")
+	if err != nil || id.Name != "name" || id.Policy.Get("group") != "admin" || id.Policy.Get("direct") != "true" {
+		t.Fatal("wrong identity", id, err)
+	}
+	if _, err := h.Validate("name", "wrong"); err == nil {
+		t.Fatal("wrong pass was validated")
+	}
+	if _, err := h.Validate("other", "pass"); err == nil {
+		t.Fatal("unknown user was validated")
+	}
+
+	reload := DefaultReloadInterval
+	DefaultReloadInterval = 0
+	defer func() {
+		DefaultReloadInterval = reload
+	}()
+	write("other:" + hash + "\n")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Validate("other", "pass"); err != nil {
+		t.Fatal("file was not reloaded", err)
+	}
+	if _, err := h.Validate("name", "pass"); err == nil {
+		t.Fatal("removed user was validated")
+	}
+}
@@ -0,0 +1,298 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/goextension/log"
+	"github.com/panjf2000/ants/v2"
+	"github.com/portmapping/go-reuse"
+	"github.com/portmapping/lurker/nat"
+)
+
+// Realm is the realm of the Proxy-Authenticate challenge
+var Realm = "lurker"
+
+var errHTTPSNoSecret = errors.New("tls config was required by the https proxy")
+
+// identityKey is the context key of the user of a forwarded request
+type identityKey struct{}
+
+// addrKey is the context key of the address checked by the rules for a forwarded request
+type addrKey struct{}
+
+// hopHeaders are meant for a single connection and are not passed on, rfc7230 section 6.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type httpProxy struct {
+	Authenticate
+	limits
+	nat       nat.NAT
+	dialer    Dialer
+	secret    *tls.Config
+	rules     *Rules
+	transport *http.Transport
+	funcPool  *ants.PoolWithFunc
+}
+
+// NewHTTPS returns an http proxy whose clients connect to it with tls
+func NewHTTPS(n nat.NAT, auth Authenticate, dialer Dialer, secret *tls.Config) (Proxy, error) {
+	if secret == nil {
+		return nil, errHTTPSNoSecret
+	}
+	return newHTTPProxy(n, auth, dialer, secret)
+}
+
+func newHTTPProxy(n nat.NAT, auth Authenticate, dialer Dialer, secret *tls.Config) (Proxy, error) {
+	p := &httpProxy{
+		Authenticate: auth,
+		nat:          n,
+		dialer:       dialer,
+		secret:       secret,
+	}
+	p.transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			id, _ := ctx.Value(identityKey{}).(*Identity)
+			//the host is dialed at the ip its request was checked against
+			if v, b := ctx.Value(addrKey{}).(string); b {
+				addr = v
+			}
+			return dialAs(p.dialer, id, network, addr)
+		},
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	if _, b := dialer.(IdentityDialer); b {
+		//an idle connection dialed for one user must not carry the requests of another
+		p.transport.DisableKeepAlives = true
+	}
+	funcPool, err := ants.NewPoolWithFunc(ants.DefaultAntsPoolSize, p.handleConnect, ants.WithNonblocking(false))
+	if err != nil {
+		return nil, err
+	}
+	p.funcPool = funcPool
+	return p, nil
+}
+
+// ListenOnPort ...
+func (p *httpProxy) ListenOnPort(port int) (net.Listener, error) {
+	tcpAddr := net.TCPAddr{
+		IP:   net.IPv4zero,
+		Port: port,
+	}
+	tcpLis, err := reuse.ListenTCP("tcp", &tcpAddr)
+	if err != nil {
+		return nil, err
+	}
+	if p.secret != nil {
+		return tls.NewListener(tcpLis, p.secret), nil
+	}
+	return tcpLis, nil
+}
+
+// SetRules ...
+func (p *httpProxy) SetRules(rules *Rules) {
+	p.rules = rules
+}
+
+// Connect ...
+func (p *httpProxy) Connect(conn net.Conn) error {
+	return p.funcPool.Invoke(conn)
+}
+
+func (p *httpProxy) handleConnect(i interface{}) {
+	conn, b := i.(net.Conn)
+	if !b {
+		return
+	}
+	defer conn.Close()
+	if err := p.serve(conn); err != nil {
+		log.Debugw("debug|handleConnect|serve", "error", err)
+	}
+}
+
+// serve answers the requests of a kept alive connection until one of them closes it
+func (p *httpProxy) serve(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		id, err := p.authorize(req)
+		if err != nil {
+			_, _ = io.Copy(ioutil.Discard, req.Body)
+			header := http.Header{}
+			header.Set("Proxy-Authenticate", `Basic realm="`+Realm+`"`)
+			if err := writeStatus(conn, http.StatusProxyAuthRequired, header); err != nil || req.Close {
+				return err
+			}
+			continue
+		}
+		if req.Method == http.MethodConnect {
+			return p.tunnel(conn, r, req, id)
+		}
+		if !req.URL.IsAbs() {
+			_ = writeStatus(conn, http.StatusBadRequest, nil)
+			return nil
+		}
+		keep, err := p.forward(conn, req, id)
+		if err != nil || !keep {
+			return err
+		}
+	}
+}
+
+// authorize returns the identity of the Basic credentials of Proxy-Authorization
+func (p *httpProxy) authorize(req *http.Request) (*Identity, error) {
+	if !p.NeedAuthenticate() {
+		return Anonymous, nil
+	}
+	name, pass, b := parseBasicAuth(req.Header.Get("Proxy-Authorization"))
+	if !b {
+		return nil, errValidationFailed
+	}
+	return p.Validate(name, pass)
+}
+
+// tunnel connects to the host of a CONNECT request and copies the bytes in both directions
+func (p *httpProxy) tunnel(conn net.Conn, r *bufio.Reader, req *http.Request, id *Identity) error {
+	addr := req.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "443")
+	}
+	log.Debugw("proxy connect", "user", id.Name, "addr", addr)
+	addr, err := p.rules.resolve(id, addr)
+	if err != nil {
+		_ = writeStatus(conn, http.StatusForbidden, nil)
+		return err
+	}
+	dial, err := dialAs(p.dialer, id, "tcp", addr)
+	if err != nil {
+		_ = writeStatus(conn, http.StatusBadGateway, nil)
+		return err
+	}
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		dial.Close()
+		return err
+	}
+	//the client may have sent the start of the tunnel along with the request
+	if n := r.Buffered(); n > 0 {
+		data, _ := r.Peek(n)
+		if _, err := dial.Write(data); err != nil {
+			dial.Close()
+			return err
+		}
+	}
+	p.transfer(conn, dial, id)
+	return nil
+}
+
+// forward sends a request of an absolute uri to its host and writes the response back,
+// false is returned when the connection is not kept alive
+func (p *httpProxy) forward(conn net.Conn, req *http.Request, id *Identity) (bool, error) {
+	log.Debugw("proxy forward", "user", id.Name, "method", req.Method, "url", req.URL.String())
+	addr, err := p.rules.resolve(id, requestAddr(req.URL))
+	if err != nil {
+		_ = writeStatus(conn, http.StatusForbidden, nil)
+		return false, err
+	}
+	keep := !req.Close
+	removeHopHeaders(req.Header)
+	req.RequestURI = ""
+	req.Close = false
+	ctx := context.WithValue(req.Context(), identityKey{}, id)
+	req = req.WithContext(context.WithValue(ctx, addrKey{}, addr))
+	resp, err := p.transport.RoundTrip(req)
+	if err != nil {
+		_ = writeStatus(conn, http.StatusBadGateway, nil)
+		return false, err
+	}
+	defer resp.Body.Close()
+	removeHopHeaders(resp.Header)
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	//a body without length and chunking is ended by closing the connection
+	resp.Close = !keep || resp.ContentLength < 0 && len(resp.TransferEncoding) == 0
+	if err := resp.Write(conn); err != nil {
+		return false, err
+	}
+	return !resp.Close, nil
+}
+
+// requestAddr is the host and port the request of an absolute uri is sent to
+func requestAddr(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// removeHopHeaders removes the hop-by-hop headers and the ones listed in Connection
+func removeHopHeaders(header http.Header) {
+	for _, v := range header["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+func writeStatus(conn net.Conn, code int, header http.Header) error {
+	if header == nil {
+		header = http.Header{}
+	}
+	resp := &http.Response{
+		StatusCode: code,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+	}
+	return resp.Write(conn)
+}
+
+// parseBasicAuth parses the credentials of a Basic authorization
+func parseBasicAuth(auth string) (name, pass string, b bool) {
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	data, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	i := strings.IndexByte(string(data), ':')
+	if i < 0 {
+		return "", "", false
+	}
+	return string(data[:i]), string(data[i+1:]), true
+}
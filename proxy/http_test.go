@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// TestHTTP_Proxy ...
+func TestHTTP_Proxy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	conn := serveProxy(t, HTTP, Auth{Name: "name", Pass: "pass"}, nil)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	roundTrip := func(req *http.Request) *http.Response {
+		if err := req.WriteProxy(conn); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(r, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	resp := roundTrip(req)
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusProxyAuthRequired || resp.Header.Get("Proxy-Authenticate") == "" {
+		t.Fatal("wrong status", resp.Status)
+	}
+	req.Header.Set("Proxy-Authorization", "Basic bmFtZTpwYXNz")
+	for i := 0; i < 2; i++ {
+		//the same connection is kept alive for the next request
+		resp = roundTrip(req)
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil || resp.StatusCode != http.StatusOK || string(body) != "hello" {
+			t.Fatal("wrong response", resp.Status, string(body), err)
+		}
+	}
+
+	echo := echoTCP(t)
+	req = &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: echo},
+		Header: http.Header{},
+	}
+	req.Header.Set("Proxy-Authorization", "Basic bmFtZTpwYXNz")
+	resp = roundTrip(req)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("wrong status", resp.Status)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(r, got); err != nil || string(got) != "hello" {
+		t.Fatal("wrong echo", string(got), err)
+	}
+}
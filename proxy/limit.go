@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+
+	"github.com/goextension/log"
+	"github.com/portmapping/lurker/pool"
+)
+
+// limits are the rates of the transfers of a proxy, each connection has its own rate
+// and the connections of a user share the rate of the user
+type limits struct {
+	rate  int64
+	users *pool.Groups
+}
+
+// SetLimits sets the rates in bytes per second, 0 is unlimited. The anonymous users
+// of a proxy without authentication share one rate
+func (l *limits) SetLimits(rate int64, userRate int64) {
+	l.rate = rate
+	l.users = pool.NewGroups(userRate, 0)
+}
+
+// transfer copies both directions of a request of the user until they are finished
+func (l *limits) transfer(conn net.Conn, dial net.Conn, id *Identity) {
+	defer l.users.Release(id.Name)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	c := pool.NewConnection(conn, dial, &wg).Limit(
+		pool.NewLimiter(l.rate, 0),
+		l.users.Get(id.Name),
+	).OnDone(func(stats pool.Stats) {
+		log.Infow("proxy transfer finished", "user", id.Name, "addr", dial.RemoteAddr(),
+			"in", stats.In, "out", stats.Out, "duration", stats.Duration, "reason", stats.Reason)
+	})
+	pool.AddConnections(c)
+	wg.Wait()
+}
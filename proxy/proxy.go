@@ -4,6 +4,7 @@ import (
 	"errors"
 	"github.com/portmapping/lurker/nat"
 	"net"
+	"time"
 )
 
 // Socks5 ...
@@ -19,13 +20,55 @@ const HTTPS = "https"
 type Proxy interface {
 	Connect(conn net.Conn) error
 	ListenOnPort(port int) (net.Listener, error)
+	//SetRules sets the access control of the requests, nil allows every destination
+	SetRules(rules *Rules)
+	//SetLimits sets the rates of each connection and of each user in bytes per second
+	SetLimits(rate int64, userRate int64)
+}
+
+// Dialer connects to the destinations of the proxy requests
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// DefaultDialTimeout is the time Direct waits for a destination to be connected
+var DefaultDialTimeout = 30 * time.Second
+
+type directDialer struct{}
+
+// Direct dials the destinations from the local machine
+var Direct Dialer = directDialer{}
+
+// Dial ...
+func (directDialer) Dial(network, addr string) (net.Conn, error) {
+	//the local address is left to the system, an ipv4 one could not reach ipv6 destinations
+	return net.DialTimeout(network, addr, DefaultDialTimeout)
+}
+
+// Supported reports whether New creates proxies of the protocol
+func Supported(protocol string) bool {
+	switch protocol {
+	case Socks5, HTTP, HTTPS:
+		return true
+	}
+	return false
 }
 
 // New ...
 func New(protocol string, n nat.NAT, auth Authenticate) (Proxy, error) {
+	return NewWithDialer(protocol, n, auth, Direct)
+}
+
+// NewWithDialer returns a proxy connecting to the destinations with the dialer,
+// an https proxy is created by NewHTTPS with the tls config of its listener
+func NewWithDialer(protocol string, n nat.NAT, auth Authenticate, dialer Dialer) (Proxy, error) {
 	switch protocol {
 	case Socks5:
-		return newSocks5Proxy(n, auth)
+		return newSocks5Proxy(n, auth, dialer)
+	case HTTP:
+		return newHTTPProxy(n, auth, dialer, nil)
+	case HTTPS:
+		return nil, errHTTPSNoSecret
 	}
 	return nil, errors.New("protocol was not supported")
 }
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/goextension/log/zap"
+)
+
+// TestMain registers the global logger the proxies log to, like the applications do
+func TestMain(m *testing.M) {
+	zap.InitZapSugar()
+	os.Exit(m.Run())
+}
+
+func freeTCPPort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func echoTCP(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func echoUDP(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	go func() {
+		data := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(data)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(data[:n], from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// handler is implemented by the proxies, it serves a connection until it is finished
+type handler interface {
+	handleConnect(i interface{})
+}
+
+// serve handles the connections of l until the test ends, then the listener and the accepted
+// connections are closed and the test waits for their handlers to return
+func serve(t *testing.T, px Proxy, l net.Listener, accepted *int32) {
+	var lock sync.Mutex
+	var conns []net.Conn
+	closed := false
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepted, 1)
+			lock.Lock()
+			if closed {
+				lock.Unlock()
+				conn.Close()
+				return
+			}
+			conns = append(conns, conn)
+			wg.Add(1)
+			lock.Unlock()
+			go func() {
+				defer wg.Done()
+				px.(handler).handleConnect(conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		lock.Lock()
+		closed = true
+		for _, conn := range conns {
+			conn.Close()
+		}
+		lock.Unlock()
+		wg.Wait()
+	})
+}
+
+// serveProxy serves a direct proxy on a free port until the test ends and returns a connection to it
+func serveProxy(t *testing.T, protocol string, auth Authenticate, rules *Rules) net.Conn {
+	px, err := New(protocol, nil, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	px.SetRules(rules)
+	l, err := px.ListenOnPort(freeTCPPort(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, px, l, new(int32))
+	conn, err := net.Dial("tcp", (&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: l.Addr().(*net.TCPAddr).Port}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	return conn
+}
+
+// listenProxy serves a direct proxy until the test ends, the accepted connections are counted
+func listenProxy(t *testing.T, protocol string, auth Authenticate) (string, *int32) {
+	px, err := New(protocol, nil, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := px.ListenOnPort(freeTCPPort(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var accepted int32
+	serve(t, px, l, &accepted)
+	return (&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: l.Addr().(*net.TCPAddr).Port}).String(), &accepted
+}
@@ -0,0 +1,276 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/goextension/log"
+)
+
+// Action ...
+const (
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+)
+
+var errNotAllowed = errors.New("connection was not allowed by ruleset")
+
+// Rule matches the requests of users to destinations, an empty list matches everything.
+// Users are names or key=value of the policy, hosts are cidrs, ips or domain suffixes
+// and ports are single ports or ranges like 8000-9000
+type Rule struct {
+	Action string   `json:"action" yaml:"action" toml:"action"`
+	Users  []string `json:"users,omitempty" yaml:"users,omitempty" toml:"users,omitempty"`
+	Hosts  []string `json:"hosts,omitempty" yaml:"hosts,omitempty" toml:"hosts,omitempty"`
+	Ports  []string `json:"ports,omitempty" yaml:"ports,omitempty" toml:"ports,omitempty"`
+}
+
+type portRange struct {
+	from, to int
+}
+
+type rule struct {
+	allow   bool
+	users   []string
+	nets    []*net.IPNet
+	domains []string
+	ports   []portRange
+}
+
+// matcher finds the first rule matching a request
+type matcher struct {
+	rules []rule
+	//lookup resolves the domains of the requests when a rule matches ips
+	lookup func(host string) ([]net.IP, error)
+	cidr   bool
+}
+
+// Rules is the access control of a proxy, the first rule matching a request decides it
+type Rules struct {
+	matcher
+	allow bool
+}
+
+// NewRules compiles the rules, the requests matched by none of them are decided by the default action
+func NewRules(rules []Rule, action string) (*Rules, error) {
+	allow, err := parseAction(action, ActionAllow)
+	if err != nil {
+		return nil, err
+	}
+	r := &Rules{
+		allow: allow,
+	}
+	if err := r.compile(rules); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Allow reports whether the user may connect to addr
+func (r *Rules) Allow(id *Identity, addr string) bool {
+	_, err := r.resolve(id, addr)
+	return err == nil
+}
+
+// resolve returns the address to connect to when the rules allow the request, nil rules allow everything.
+// A domain resolved for the cidr rules is replaced by the checked ip, so that it can not be rebound to another one
+func (r *Rules) resolve(id *Identity, addr string) (string, error) {
+	if r == nil {
+		return addr, nil
+	}
+	i, ip, err := r.find(id, addr)
+	if err != nil {
+		log.Debugw("debug|Rules|find", "addr", addr, "error", err)
+		return "", errNotAllowed
+	}
+	allow := r.allow
+	if i >= 0 {
+		allow = r.rules[i].allow
+	}
+	if !allow {
+		return "", errNotAllowed
+	}
+	if ip == nil {
+		return addr, nil
+	}
+	_, port, _ := net.SplitHostPort(addr)
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+func (m *matcher) compile(rules []Rule) error {
+	m.lookup = net.LookupIP
+	for i, v := range rules {
+		c, err := compileRule(v)
+		if err != nil {
+			return fmt.Errorf("rule %v was wrong: %w", i, err)
+		}
+		if len(c.nets) > 0 {
+			m.cidr = true
+		}
+		m.rules = append(m.rules, c)
+	}
+	return nil
+}
+
+// find returns the index of the first rule matching the request, -1 when none matches,
+// and the ip the domain of the request was resolved into when the rules match ips
+func (m *matcher) find(id *Identity, addr string) (int, net.IP, error) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return -1, nil, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return -1, nil, err
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	var ips []net.IP
+	var resolved net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else if m.cidr {
+		//a domain resolving into a matched network is matched as well,
+		//a domain which can not be resolved matches no rule safely
+		ips, err = m.lookup(host)
+		if err != nil {
+			return -1, nil, err
+		}
+		if len(ips) == 0 {
+			return -1, nil, fmt.Errorf("host %v was not resolved", host)
+		}
+		resolved = ips[0]
+		ips = ips[:1]
+	}
+	for i, v := range m.rules {
+		if v.match(id, host, ips, port) {
+			return i, resolved, nil
+		}
+	}
+	return -1, resolved, nil
+}
+
+func compileRule(v Rule) (rule, error) {
+	allow, err := parseAction(v.Action, "")
+	if err != nil {
+		return rule{}, err
+	}
+	c := rule{
+		allow: allow,
+		users: v.Users,
+	}
+	for _, h := range v.Hosts {
+		h = strings.ToLower(strings.TrimSpace(h))
+		switch {
+		case strings.Contains(h, "/"):
+			_, n, err := net.ParseCIDR(h)
+			if err != nil {
+				return rule{}, err
+			}
+			c.nets = append(c.nets, n)
+		case net.ParseIP(h) != nil:
+			ip := net.ParseIP(h)
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			c.nets = append(c.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		case h == "":
+			return rule{}, errors.New("host was empty")
+		default:
+			c.domains = append(c.domains, strings.TrimPrefix(strings.TrimPrefix(h, "*"), "."))
+		}
+	}
+	for _, p := range v.Ports {
+		pr, err := parsePortRange(p)
+		if err != nil {
+			return rule{}, err
+		}
+		c.ports = append(c.ports, pr)
+	}
+	return c, nil
+}
+
+func parseAction(action string, def string) (bool, error) {
+	if action == "" {
+		action = def
+	}
+	switch action {
+	case ActionAllow:
+		return true, nil
+	case ActionDeny:
+		return false, nil
+	}
+	return false, fmt.Errorf("action %v was not supported", action)
+}
+
+func parsePortRange(s string) (portRange, error) {
+	from, to := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		from, to = s[:i], s[i+1:]
+	}
+	f, err1 := strconv.Atoi(strings.TrimSpace(from))
+	t, err2 := strconv.Atoi(strings.TrimSpace(to))
+	if err1 != nil || err2 != nil || f < 0 || t > 65535 || f > t {
+		return portRange{}, fmt.Errorf("port %v was wrong", s)
+	}
+	return portRange{from: f, to: t}, nil
+}
+
+func (c rule) match(id *Identity, host string, ips []net.IP, port int) bool {
+	return c.matchUser(id) && c.matchHost(host, ips) && c.matchPort(port)
+}
+
+func (c rule) matchUser(id *Identity) bool {
+	if len(c.users) == 0 {
+		return true
+	}
+	if id == nil {
+		id = Anonymous
+	}
+	for _, u := range c.users {
+		if i := strings.Index(u, "="); i >= 0 {
+			if v, b := id.Policy[u[:i]]; b && v == u[i+1:] {
+				return true
+			}
+			continue
+		}
+		if u == id.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c rule) matchHost(host string, ips []net.IP) bool {
+	if len(c.nets) == 0 && len(c.domains) == 0 {
+		return true
+	}
+	for _, d := range c.domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	for _, n := range c.nets {
+		for _, ip := range ips {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c rule) matchPort(port int) bool {
+	if len(c.ports) == 0 {
+		return true
+	}
+	for _, p := range c.ports {
+		if port >= p.from && port <= p.to {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// TestRules_Allow ...
+func TestRules_Allow(t *testing.T) {
+	rules, err := NewRules([]Rule{
+		{Action: ActionAllow, Users: []string{"group=admin"}},
+		{Action: ActionDeny, Hosts: []string{"10.0.0.0/8", "127.0.0.0/8", "::1"}},
+		{Action: ActionDeny, Hosts: []string{"*.example.com"}, Ports: []string{"1-442", "444-65535"}},
+		{Action: ActionAllow, Users: []string{"name"}, Ports: []string{"22"}},
+		{Action: ActionDeny, Ports: []string{"22"}},
+	}, ActionAllow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := map[string]net.IP{
+		"localhost":   net.IPv4(127, 0, 0, 1),
+		"example.com": net.IPv4(192, 0, 2, 2),
+	}
+	rules.lookup = func(host string) ([]net.IP, error) {
+		if ip, b := hosts[host]; b {
+			return []net.IP{ip}, nil
+		}
+		return nil, errors.New("host was not found")
+	}
+	admin := &Identity{Name: "root", Policy: Policy{"group": "admin"}}
+	user := &Identity{Name: "name"}
+	tests := []struct {
+		name string
+		id   *Identity
+		addr string
+		want bool
+	}{
+		{"cidr", Anonymous, "10.1.2.3:80", false},
+		{"ip", Anonymous, "[::1]:80", false},
+		{"resolved", Anonymous, "localhost:80", false},
+		{"policy", admin, "10.1.2.3:80", true},
+		{"domain", Anonymous, "www.example.com:80", false},
+		{"domain port", Anonymous, "example.com:443", true},
+		{"user port", user, "192.0.2.1:22", true},
+		{"port", Anonymous, "192.0.2.1:22", false},
+		{"default", Anonymous, "192.0.2.1:80", true},
+		{"unresolved", Anonymous, "unknown.example.org:80", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rules.Allow(tt.id, tt.addr); got != tt.want {
+				t.Fatal("wrong decision", got)
+			}
+		})
+	}
+	if addr, err := rules.resolve(Anonymous, "example.com:443"); err != nil || addr != "192.0.2.2:443" {
+		t.Fatal("checked ip was not dialed", addr, err)
+	}
+	if _, err := NewRules([]Rule{{Action: ActionDeny, Ports: []string{"2-1"}}}, ""); err == nil {
+		t.Fatal("wrong port range was compiled")
+	}
+
+	conn := serveProxy(t, Socks5, NoAuth(), rules)
+	defer conn.Close()
+	if _, err := conn.Write(socksRequest(1, 1, []byte{127, 0, 0, 1}, 80)); err != nil {
+		t.Fatal(err)
+	}
+	if reply := readReply(t, conn); reply == nil || reply[1] != 2 {
+		t.Fatal("wrong reply", reply)
+	}
+}
@@ -1,19 +1,15 @@
 package proxy
 
 import (
-	"encoding/binary"
+	"bytes"
 	"errors"
 	"fmt"
 	"github.com/goextension/log"
 	"github.com/panjf2000/ants/v2"
 	"github.com/portmapping/go-reuse"
-	"github.com/portmapping/lurker/common"
 	"github.com/portmapping/lurker/nat"
-	"github.com/portmapping/lurker/pool"
-	"io"
 	"net"
-	"strconv"
-	"sync"
+	"time"
 )
 
 const (
@@ -47,13 +43,19 @@ const (
 
 type socks5 struct {
 	Authenticate
+	limits
 	nat      nat.NAT
+	dialer   Dialer
+	rules    *Rules
 	funcPool *ants.PoolWithFunc
 }
 
 var errAddressTypeNotSupported = errors.New("common type not supported")
 var errCommandNotSupported = errors.New("command not supported")
 
+// DefaultBindTimeout is the time a bind request waits for the incoming connection
+var DefaultBindTimeout = 2 * time.Minute
+
 // ListenOnPort ...
 func (s *socks5) ListenOnPort(port int) (net.Listener, error) {
 	tcpAddr := net.TCPAddr{
@@ -67,16 +69,22 @@ func (s *socks5) ListenOnPort(port int) (net.Listener, error) {
 	return tcpLis, nil
 }
 
+// SetRules ...
+func (s *socks5) SetRules(rules *Rules) {
+	s.rules = rules
+}
+
 // Connect ...
 func (s *socks5) Connect(conn net.Conn) error {
 	return s.funcPool.Invoke(conn)
 }
 
-func newSocks5Proxy(n nat.NAT, auth Authenticate) (Proxy, error) {
+func newSocks5Proxy(n nat.NAT, auth Authenticate, dialer Dialer) (Proxy, error) {
 
 	s := &socks5{
 		nat:          n,
 		Authenticate: auth,
+		dialer:       dialer,
 	}
 	funcPool, err := ants.NewPoolWithFunc(ants.DefaultAntsPoolSize, s.handleConnect, ants.WithNonblocking(false))
 	if err != nil {
@@ -86,36 +94,36 @@ func newSocks5Proxy(n nat.NAT, auth Authenticate) (Proxy, error) {
 	return s, nil
 }
 
-func (s *socks5) procedureProc(conn net.Conn) (err error) {
+// procedureProc negotiates the method and returns the identity of the client
+func (s *socks5) procedureProc(conn net.Conn) (id *Identity, err error) {
 	defer func() {
 		if err != nil {
 			conn.Close()
 		}
 	}()
-	buf := make([]byte, 2)
-	if _, err := io.ReadFull(conn, buf); err != nil {
-		return fmt.Errorf("failed read socks5 data: %w", err)
+	methods, err := readMethods(conn)
+	if err != nil {
+		return nil, err
 	}
-
-	if version := buf[0]; version != socks5Version {
-		return fmt.Errorf("wrong socks5 version: %v", version)
+	method := uint8(0)
+	if s.NeedAuthenticate() {
+		method = userPassAuth
 	}
-	nMethods := buf[1]
-	methods := make([]byte, nMethods)
-	if len, err := conn.Read(methods); len != int(nMethods) || err != nil {
-		return fmt.Errorf("wrong nmethod: %w", err)
+	if bytes.IndexByte(methods, method) < 0 {
+		_, _ = conn.Write([]byte{socks5Version, noAcceptableMethods})
+		return nil, errNoAcceptableMethod
 	}
-	if s.NeedAuthenticate() {
-		buf[1] = userPassAuth
-		conn.Write(buf)
-		if err := s.Auth(conn); err != nil {
-			return fmt.Errorf("validation failed: %w", err)
-		}
-	} else {
-		buf[1] = 0
-		conn.Write(buf)
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return nil, err
 	}
-	return nil
+	if method != userPassAuth {
+		return Anonymous, nil
+	}
+	id, err = s.Auth(conn)
+	if err != nil {
+		return nil, fmt.Errorf("validation failed: %w", err)
+	}
+	return id, nil
 }
 
 /*
@@ -154,125 +162,119 @@ Requests
    and destination addresses, and return one or more reply messages, as
    appropriate for the request type.
 */
-func doRequests(conn net.Conn) (err error) {
-	defer func() {
-		if err != nil {
-			conn.Close()
-		}
-	}()
-	header := make([]byte, 3)
-
-	_, err = io.ReadFull(conn, header)
+func (s *socks5) doRequests(conn net.Conn, id *Identity) (err error) {
+	defer conn.Close()
+	cmd, addr, err := readRequest(conn)
 	if err != nil {
-		return
+		switch err {
+		case errAddressTypeNotSupported:
+			_ = writeReply(conn, repAddressTypeNotSupported, nil)
+		case errEmptyDomain:
+			_ = writeReply(conn, repGeneralSOCKSServerFailure, nil)
+		}
+		return err
 	}
-	switch header[1] {
+	switch cmd {
 	case cmdConnect:
-		log.Debugw("proxy connect")
-		e := connect(cmdConnect, conn)
-		if e == errAddressTypeNotSupported {
-			err = doReplies(conn, repAddressTypeNotSupported, atypIPv4Address)
-			if err != nil {
-				log.Debugw("reply error", "error", err)
-			}
-		}
+		log.Debugw("proxy connect", "user", id.Name, "addr", addr)
+		return s.connect(conn, addr, id)
 	case cmdBind:
+		log.Debugw("proxy bind", "user", id.Name, "addr", addr)
+		return s.bind(conn, addr, id)
 	case cmdUDPAssociate:
+		log.Debugw("proxy udp associate", "user", id.Name, "addr", addr)
+		return s.associate(conn, addr, id)
 	}
-	conn.Write([]byte{socks5Version, repCommandNotSupported})
-	conn.Close()
-	return nil
+	_ = writeReply(conn, repCommandNotSupported, nil)
+	return errCommandNotSupported
 }
 
 func (s *socks5) handleConnect(i interface{}) {
-	fmt.Println("handle Connect")
 	conn, b := i.(net.Conn)
 	if !b {
 		return
 	}
-	if err := s.procedureProc(conn); err != nil {
+	id, err := s.procedureProc(conn)
+	if err != nil {
 		return
 	}
-	if err := doRequests(conn); err != nil {
+	if err := s.doRequests(conn, id); err != nil {
 		return
 	}
 }
 
-func getAddrPort(conn net.Conn) (addr string, err error) {
-	addrType := make([]byte, 1)
-	_, err = conn.Read(addrType)
+func (s *socks5) connect(conn net.Conn, addr string, id *Identity) error {
+	addr, err := s.rules.resolve(id, addr)
 	if err != nil {
-		return "", err
-	}
-	var host string
-	switch addrType[0] {
-	case atypIPv4Address:
-		ipv4 := make(net.IP, net.IPv4len)
-		conn.Read(ipv4)
-		host = ipv4.String()
-	case atypIPv6Address:
-		ipv6 := make(net.IP, net.IPv6len)
-		conn.Read(ipv6)
-		host = ipv6.String()
-	case atypDomainName:
-		var domainLen uint8
-		binary.Read(conn, binary.BigEndian, &domainLen)
-		domain := make([]byte, domainLen)
-		conn.Read(domain)
-		host = string(domain)
-	default:
-		return "", errAddressTypeNotSupported
+		_ = writeReply(conn, repConnectionNotAlloweByRuleset, nil)
+		return err
 	}
-	log.Debugw("proxy get addr")
-	var port uint16
-	err = binary.Read(conn, binary.BigEndian, &port)
+	dial, err := dialAs(s.dialer, id, "tcp", addr)
 	if err != nil {
-		return "", err
+		_ = writeReply(conn, replyOf(err), nil)
+		return err
+	}
+	if err := writeReply(conn, repSucceeded, dial.LocalAddr()); err != nil {
+		dial.Close()
+		return err
 	}
-	// connect to host
-	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+	s.transfer(conn, dial, id)
+	return nil
 }
 
-func connect(cmd int, conn net.Conn) error {
-	addr, e := getAddrPort(conn)
-	if e != nil {
-		return e
+// bind listens for the connection the client expects from addr, the first reply carries the
+// listening address and the second one the address of the host which connected
+func (s *socks5) bind(conn net.Conn, addr string, id *Identity) error {
+	if s.dialer != Direct {
+		//the listener of an exit peer can not be reached through the dialer
+		_ = writeReply(conn, repCommandNotSupported, nil)
+		return errCommandNotSupported
 	}
-	tcpAddr, e := net.ResolveTCPAddr("tcp", addr)
-	if e != nil {
-		return e
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		_ = writeReply(conn, repGeneralSOCKSServerFailure, nil)
+		return err
 	}
-	localTCPAddr := common.LocalTCPAddr(0)
-	dial, err := net.DialTCP("tcp", localTCPAddr, tcpAddr)
+	expect := net.ParseIP(host)
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: localIP(conn.LocalAddr())})
 	if err != nil {
+		_ = writeReply(conn, repGeneralSOCKSServerFailure, nil)
 		return err
 	}
-
-	e = doReplies(conn, repSucceeded, atypIPv4Address)
-	if e != nil {
-		return e
+	defer l.Close()
+	if err := writeReply(conn, repSucceeded, l.Addr()); err != nil {
+		return err
+	}
+	if err := l.SetDeadline(time.Now().Add(DefaultBindTimeout)); err != nil {
+		_ = writeReply(conn, repGeneralSOCKSServerFailure, nil)
+		return err
+	}
+	for {
+		peer, err := l.AcceptTCP()
+		if err != nil {
+			_ = writeReply(conn, repTTLExpired, nil)
+			return err
+		}
+		remote := peer.RemoteAddr().(*net.TCPAddr)
+		if expect != nil && !expect.IsUnspecified() && !expect.Equal(remote.IP) {
+			log.Debugw("proxy bind refused", "addr", remote)
+			peer.Close()
+			continue
+		}
+		l.Close()
+		if err := writeReply(conn, repSucceeded, remote); err != nil {
+			peer.Close()
+			return err
+		}
+		s.transfer(conn, peer, id)
+		return nil
 	}
-	wg := sync.WaitGroup{}
-
-	wg.Add(1)
-	pool.AddConnections(pool.NewConnection(conn, dial, &wg))
-	wg.Wait()
-	return nil
 }
 
-func doReplies(conn net.Conn, rep byte, atyp byte) (err error) {
-	reply := []byte{
-		socks5Version,
-		rep,
-		rsvRESERVED,
-		atyp,
+// localIP is the ip the client connected to, the relay sockets are bound on it
+func localIP(addr net.Addr) net.IP {
+	if tcpAddr, b := addr.(*net.TCPAddr); b {
+		return tcpAddr.IP
 	}
-	addr := common.ParseNetAddr(conn.LocalAddr())
-	reply = append(reply, addr.IP.To4()...)
-	portBytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(portBytes, uint16(addr.Port))
-	reply = append(reply, portBytes...)
-
-	_, err = conn.Write(reply)
-	return
+	return nil
 }
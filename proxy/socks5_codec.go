@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+const noAcceptableMethods = uint8(0xFF)
+
+var errEmptyDomain = errors.New("domain name was empty")
+var errNoAcceptableMethod = errors.New("no acceptable method was offered")
+
+// readMethods reads VER, NMETHODS and METHODS of the method selection message
+func readMethods(r io.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed read socks5 data: %w", err)
+	}
+	if version := header[0]; version != socks5Version {
+		return nil, fmt.Errorf("wrong socks5 version: %v", version)
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, fmt.Errorf("wrong nmethod: %w", err)
+	}
+	return methods, nil
+}
+
+// readRequest reads VER, CMD, RSV and the destination of a request
+func readRequest(r io.Reader) (cmd byte, addr string, err error) {
+	header := make([]byte, 3)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return 0, "", err
+	}
+	if version := header[0]; version != socks5Version {
+		return 0, "", fmt.Errorf("wrong socks5 version: %v", version)
+	}
+	addr, err = readAddr(r)
+	return header[1], addr, err
+}
+
+// readAddr reads ATYP, ADDR and PORT of a request or of a udp datagram header
+func readAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case atypIPv4Address:
+		ip := make(net.IP, net.IPv4len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case atypIPv6Address:
+		ip := make(net.IP, net.IPv6len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case atypDomainName:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(r, size); err != nil {
+			return "", err
+		}
+		if size[0] == 0 {
+			return "", errEmptyDomain
+		}
+		domain := make([]byte, size[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", errAddressTypeNotSupported
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+/*
+Replies
+        +----+-----+-------+------+----------+----------+
+        |VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
+        +----+-----+-------+------+----------+----------+
+        | 1  |  1  | X'00' |  1   | Variable |    2     |
+        +----+-----+-------+------+----------+----------+
+
+   A nil addr is replied as 0.0.0.0:0, which is what the failure replies carry.
+*/
+func writeReply(w io.Writer, rep byte, addr net.Addr) error {
+	reply := appendAddr([]byte{socks5Version, rep, rsvRESERVED}, addr)
+	_, err := w.Write(reply)
+	return err
+}
+
+// appendAddr appends ATYP, ADDR and PORT of the address, ipv4 mapped ipv6 addresses are
+// encoded as ipv4 and the addresses without an ip as 0.0.0.0
+func appendAddr(data []byte, addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch v := addr.(type) {
+	case nil:
+	case *net.TCPAddr:
+		ip, port = v.IP, v.Port
+	case *net.UDPAddr:
+		ip, port = v.IP, v.Port
+	default:
+		host, p, err := net.SplitHostPort(addr.String())
+		if err == nil {
+			ip = net.ParseIP(host)
+			port, _ = strconv.Atoi(p)
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		data = append(append(data, atypIPv4Address), ip4...)
+	} else if ip16 := ip.To16(); ip16 != nil {
+		data = append(append(data, atypIPv6Address), ip16...)
+	} else {
+		data = append(append(data, atypIPv4Address), net.IPv4zero.To4()...)
+	}
+	return append(data, byte(port>>8), byte(port))
+}
+
+// replyOf maps the error of a dial to the reply code
+func replyOf(err error) byte {
+	if e, b := err.(net.Error); b && e.Timeout() {
+		return repTTLExpired
+	}
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return repConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return repNetworkUnreachable
+	}
+	return repHostUnreachable
+}
@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestSocks5_Associate ...
+func TestSocks5_Associate(t *testing.T) {
+	echo, err := net.ResolveUDPAddr("udp", echoUDP(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	port := client.LocalAddr().(*net.UDPAddr).Port
+
+	conn := serveProxy(t, Socks5, NoAuth(), nil)
+	defer conn.Close()
+	req := []byte{5, 1, 0, 5, 3, 0, 1, 127, 0, 0, 1, byte(port >> 8), byte(port)}
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp[1] != 0 || resp[3] != 0 || resp[5] != 1 {
+		t.Fatal("wrong reply", resp)
+	}
+	relay := &net.UDPAddr{IP: net.IP(resp[6:10]), Port: int(resp[10])<<8 | int(resp[11])}
+
+	header := []byte{0, 0, 0, 1, 127, 0, 0, 1, byte(echo.Port >> 8), byte(echo.Port)}
+	//a fragment is dropped, only the whole datagram comes back
+	if _, err := client.WriteToUDP(append([]byte{0, 0, 1}, header[3:]...), relay); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.WriteToUDP(append(header, []byte("hello")...), relay); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	data := make([]byte, 1500)
+	n, _, err := client.ReadFromUDP(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[:n], append(header, []byte("hello")...)) {
+		t.Fatal("wrong datagram", data[:n])
+	}
+
+	//the association ends with the control connection
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	if _, err := client.WriteToUDP(append(header, []byte("hello")...), relay); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, _, err := client.ReadFromUDP(data); err == nil {
+		t.Fatal("association was not closed")
+	}
+}
+
+// TestSocks5_Bind ...
+func TestSocks5_Bind(t *testing.T) {
+	conn := serveProxy(t, Socks5, NoAuth(), nil)
+	defer conn.Close()
+	req := []byte{5, 1, 0, 5, 2, 0, 1, 127, 0, 0, 1, 0, 0}
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp[1] != 0 || resp[3] != 0 {
+		t.Fatal("wrong reply", resp)
+	}
+	bound := &net.TCPAddr{IP: net.IP(resp[6:10]), Port: int(resp[10])<<8 | int(resp[11])}
+	peer, err := net.DialTCP("tcp", nil, bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0 || int(reply[8])<<8|int(reply[9]) != peer.LocalAddr().(*net.TCPAddr).Port {
+		t.Fatal("wrong peer reply", reply)
+	}
+	if _, err := peer.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "hello" {
+		t.Fatal("wrong data", string(got), err)
+	}
+}
+
+// socksRequest is the method selection without authentication followed by a request
+func socksRequest(cmd byte, atyp byte, addr []byte, port int) []byte {
+	req := []byte{5, 1, 0, 5, cmd, 0, atyp}
+	if atyp == 3 {
+		req = append(req, byte(len(addr)))
+	}
+	req = append(req, addr...)
+	return append(req, byte(port>>8), byte(port))
+}
+
+// readReply reads the method selection and the reply, nil is returned when the proxy closed first
+func readReply(t *testing.T, conn net.Conn) []byte {
+	reply := make([]byte, 2+4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil
+	}
+	size := net.IPv4len
+	if reply[5] == 4 {
+		size = net.IPv6len
+	}
+	addr := make([]byte, size+2)
+	if _, err := io.ReadFull(conn, addr); err != nil {
+		t.Fatal(err)
+	}
+	return append(reply[2:], addr...)
+}
+
+// TestSocks5_Request ...
+func TestSocks5_Request(t *testing.T) {
+	echo := echoTCP(t)
+	_, p, _ := net.SplitHostPort(echo)
+	port, _ := strconv.Atoi(p)
+	closed := freeTCPPort(t)
+	tests := []struct {
+		name string
+		ipv6 bool
+		req  []byte
+		rep  byte
+		atyp byte
+	}{
+		{"ipv4", false, socksRequest(1, 1, []byte{127, 0, 0, 1}, port), 0, 1},
+		{"domain", false, socksRequest(1, 3, []byte("127.0.0.1"), port), 0, 1},
+		{"ipv6", true, socksRequest(1, 4, net.IPv6loopback, 0), 0, 4},
+		{"refused", false, socksRequest(1, 1, []byte{127, 0, 0, 1}, closed), 5, 1},
+		{"empty domain", false, socksRequest(1, 3, nil, port), 1, 1},
+		{"address type", false, socksRequest(1, 2, []byte{127, 0, 0, 1}, port), 8, 1},
+		{"command", false, socksRequest(9, 1, []byte{127, 0, 0, 1}, port), 7, 1},
+		{"version", false, append([]byte{5, 1, 0, 4}, socksRequest(1, 1, []byte{127, 0, 0, 1}, port)[4:]...), 0xFF, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.ipv6 {
+				l, err := net.Listen("tcp", "[::1]:0")
+				if err != nil {
+					t.Skip("ipv6 was not available")
+				}
+				defer l.Close()
+				go func() {
+					conn, err := l.Accept()
+					if err == nil {
+						conn.Close()
+					}
+				}()
+				v6 := l.Addr().(*net.TCPAddr).Port
+				tt.req[len(tt.req)-2], tt.req[len(tt.req)-1] = byte(v6>>8), byte(v6)
+			}
+			conn := serveProxy(t, Socks5, NoAuth(), nil)
+			defer conn.Close()
+			if _, err := conn.Write(tt.req); err != nil {
+				t.Fatal(err)
+			}
+			reply := readReply(t, conn)
+			if tt.rep == 0xFF {
+				if reply != nil {
+					t.Fatal("wrong version was replied", reply)
+				}
+				return
+			}
+			if reply == nil || reply[0] != 5 || reply[1] != tt.rep || reply[2] != 0 || reply[3] != tt.atyp {
+				t.Fatal("wrong reply", reply)
+			}
+		})
+	}
+}
+
+// TestSocks5_Auth ...
+func TestSocks5_Auth(t *testing.T) {
+	auth := NewCallbackAuth(func(name, pass string) (*Identity, error) {
+		if name != "name" || pass != "pass" {
+			return nil, errors.New("wrong pass")
+		}
+		return nil, nil
+	})
+	tests := []struct {
+		name string
+		req  []byte
+		want []byte
+	}{
+		{"no method", []byte{5, 1, 0}, []byte{5, 0xFF}},
+		{"wrong pass", []byte{5, 1, 2, 1, 4, 'n', 'a', 'm', 'e', 5, 'w', 'r', 'o', 'n', 'g'}, []byte{5, 2, 1, 1}},
+		{"pass", []byte{5, 1, 2, 1, 4, 'n', 'a', 'm', 'e', 4, 'p', 'a', 's', 's'}, []byte{5, 2, 1, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := serveProxy(t, Socks5, auth, nil)
+			defer conn.Close()
+			if _, err := conn.Write(tt.req); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, len(tt.want))
+			if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, tt.want) {
+				t.Fatal("wrong reply", got, err)
+			}
+		})
+	}
+}
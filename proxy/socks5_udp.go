@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"github.com/goextension/log"
+)
+
+/*
+UDP ASSOCIATE
+   A UDP-based client MUST send its datagrams to the UDP relay server at
+   the UDP port indicated by BND.PORT in the reply to the UDP ASSOCIATE
+   request. Each datagram carries a UDP request header with it:
+
+        +----+------+------+----------+----------+----------+
+        |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+        +----+------+------+----------+----------+----------+
+        | 2  |  1   |  1   | Variable |    2     | Variable |
+        +----+------+------+----------+----------+----------+
+
+   A UDP association terminates when the TCP connection that the UDP
+   ASSOCIATE request arrived on terminates.
+*/
+
+// association relays the datagrams of one client, the client is learned from the first datagram
+// arriving from the address given in the request
+type association struct {
+	conn   *net.UDPConn
+	ip     net.IP
+	port   int
+	lock   sync.RWMutex
+	client *net.UDPAddr
+	id     *Identity
+	rules  *Rules
+}
+
+// associate opens the relay socket and keeps it as long as the control connection is open
+func (s *socks5) associate(conn net.Conn, addr string, id *Identity) error {
+	if s.dialer != Direct {
+		//datagrams can not be carried by the streams of an exit peer
+		_ = writeReply(conn, repCommandNotSupported, nil)
+		return errCommandNotSupported
+	}
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP(conn.LocalAddr())})
+	if err != nil {
+		_ = writeReply(conn, repGeneralSOCKSServerFailure, nil)
+		return err
+	}
+	defer udp.Close()
+	a := newAssociation(udp, conn.RemoteAddr(), addr)
+	a.id, a.rules = id, s.rules
+	if err := writeReply(conn, repSucceeded, udp.LocalAddr()); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.serve()
+	}()
+	//nothing more is expected on the control connection, its end closes the association
+	_, _ = io.Copy(ioutil.Discard, conn)
+	udp.Close()
+	<-done
+	log.Debugw("proxy udp associate finished", "addr", udp.LocalAddr())
+	return nil
+}
+
+// newAssociation accepts the client from the ip of the control connection, the port is only
+// checked when the client gave it in the request
+func newAssociation(conn *net.UDPConn, remote net.Addr, addr string) *association {
+	a := &association{
+		conn: conn,
+	}
+	if tcpAddr, b := remote.(*net.TCPAddr); b {
+		a.ip = tcpAddr.IP
+	}
+	if udpAddr, err := net.ResolveUDPAddr("udp", addr); err == nil {
+		if udpAddr.IP != nil && !udpAddr.IP.IsUnspecified() {
+			a.ip = udpAddr.IP
+		}
+		a.port = udpAddr.Port
+	}
+	return a
+}
+
+func (a *association) serve() {
+	data := make([]byte, 65535)
+	for {
+		n, from, err := a.conn.ReadFromUDP(data)
+		if err != nil {
+			return
+		}
+		if a.fromClient(from) {
+			a.send(data[:n])
+			continue
+		}
+		a.receive(data[:n], from)
+	}
+}
+
+func (a *association) fromClient(from *net.UDPAddr) bool {
+	a.lock.RLock()
+	client := a.client
+	a.lock.RUnlock()
+	if client != nil {
+		return client.IP.Equal(from.IP) && client.Port == from.Port
+	}
+	if a.ip != nil && !a.ip.Equal(from.IP) || a.port != 0 && a.port != from.Port {
+		return false
+	}
+	a.lock.Lock()
+	a.client = from
+	a.lock.Unlock()
+	return true
+}
+
+// send strips the header of a client datagram and sends the data to its destination,
+// fragments and the datagrams denied by the rules are dropped
+func (a *association) send(data []byte) {
+	if len(data) < 4 || data[2] != 0 {
+		return
+	}
+	r := bytes.NewReader(data[3:])
+	addr, err := readAddr(r)
+	if err != nil {
+		log.Debugw("debug|send|readAddr", "error", err)
+		return
+	}
+	addr, err = a.rules.resolve(a.id, addr)
+	if err != nil {
+		log.Debugw("debug|send|resolve", "error", err)
+		return
+	}
+	dst, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		log.Debugw("debug|send|ResolveUDPAddr", "error", err)
+		return
+	}
+	_, err = a.conn.WriteToUDP(data[len(data)-r.Len():], dst)
+	if err != nil {
+		log.Debugw("debug|send|WriteToUDP", "error", err)
+	}
+}
+
+// receive wraps a datagram of a remote host with the header and passes it to the client
+func (a *association) receive(data []byte, from *net.UDPAddr) {
+	a.lock.RLock()
+	client := a.client
+	a.lock.RUnlock()
+	if client == nil {
+		return
+	}
+	packet := appendAddr([]byte{rsvRESERVED, rsvRESERVED, 0}, from)
+	packet = append(packet, data...)
+	_, err := a.conn.WriteToUDP(packet, client)
+	if err != nil {
+		log.Debugw("debug|receive|WriteToUDP", "error", err)
+	}
+}
@@ -0,0 +1,318 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// routeDirect is the upstream of the routes connecting without one
+const routeDirect = "direct"
+
+// PolicyUpstream is the policy key of a user naming the upstream of all its requests
+const PolicyUpstream = "upstream"
+
+var errUpstreamMethod = errors.New("no acceptable method was replied by the upstream")
+var errUpstreamNetwork = errors.New("network was not supported by the upstream")
+
+// IdentityDialer is a dialer choosing the connection by the user of the request
+type IdentityDialer interface {
+	Dialer
+	DialAs(id *Identity, network, addr string) (net.Conn, error)
+}
+
+// Route selects the upstream of the requests it matches like a Rule, an empty or direct upstream
+// connects without one
+type Route struct {
+	Upstream string   `json:"upstream" yaml:"upstream" toml:"upstream"`
+	Users    []string `json:"users,omitempty" yaml:"users,omitempty" toml:"users,omitempty"`
+	Hosts    []string `json:"hosts,omitempty" yaml:"hosts,omitempty" toml:"hosts,omitempty"`
+	Ports    []string `json:"ports,omitempty" yaml:"ports,omitempty" toml:"ports,omitempty"`
+}
+
+// Router connects to the destinations through the upstream of the first matching route,
+// the requests matched by none go through the default dialer
+type Router struct {
+	matcher
+	dialers   []Dialer
+	upstreams map[string]Dialer
+	def       Dialer
+}
+
+type socks5Dialer struct {
+	addr    string
+	auth    *Auth
+	forward Dialer
+}
+
+type httpDialer struct {
+	addr    string
+	auth    *Auth
+	secret  *tls.Config
+	forward Dialer
+}
+
+// bufferedConn reads the bytes buffered by the reader of the handshake first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// NewUpstream returns a dialer connecting through the proxy of the protocol at addr, the
+// connection to the proxy itself is made by forward. An https upstream is verified by secret
+func NewUpstream(protocol string, addr string, auth *Auth, secret *tls.Config, forward Dialer) (Dialer, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("upstream address was wrong: %w", err)
+	}
+	if forward == nil {
+		forward = Direct
+	}
+	switch protocol {
+	case Socks5:
+		return &socks5Dialer{addr: addr, auth: auth, forward: forward}, nil
+	case HTTP:
+		return &httpDialer{addr: addr, auth: auth, forward: forward}, nil
+	case HTTPS:
+		if secret == nil {
+			secret = &tls.Config{}
+		}
+		return &httpDialer{addr: addr, auth: auth, secret: secret, forward: forward}, nil
+	}
+	return nil, fmt.Errorf("upstream protocol %v was not supported", protocol)
+}
+
+// NewRouter compiles the routes, their upstreams must be found in upstreams.
+// A nil def connects the unmatched requests directly
+func NewRouter(upstreams map[string]Dialer, routes []Route, def Dialer) (*Router, error) {
+	if def == nil {
+		def = Direct
+	}
+	r := &Router{
+		upstreams: upstreams,
+		def:       def,
+	}
+	rules := make([]Rule, len(routes))
+	for i, v := range routes {
+		d, err := r.upstream(v.Upstream)
+		if err != nil {
+			return nil, fmt.Errorf("route %v was wrong: %w", i, err)
+		}
+		r.dialers = append(r.dialers, d)
+		rules[i] = Rule{
+			Action: ActionAllow,
+			Users:  v.Users,
+			Hosts:  v.Hosts,
+			Ports:  v.Ports,
+		}
+	}
+	if err := r.compile(rules); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Dial ...
+func (r *Router) Dial(network, addr string) (net.Conn, error) {
+	return r.DialAs(Anonymous, network, addr)
+}
+
+// DialAs prefers the upstream named by the policy of the user to the routes
+func (r *Router) DialAs(id *Identity, network, addr string) (net.Conn, error) {
+	if id != nil {
+		if name := id.Policy.Get(PolicyUpstream); name != "" {
+			d, err := r.upstream(name)
+			if err != nil {
+				return nil, err
+			}
+			return d.Dial(network, addr)
+		}
+	}
+	i, _, err := r.find(id, addr)
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 {
+		return r.def.Dial(network, addr)
+	}
+	return r.dialers[i].Dial(network, addr)
+}
+
+func (r *Router) upstream(name string) (Dialer, error) {
+	if name == "" || name == routeDirect {
+		return Direct, nil
+	}
+	d, b := r.upstreams[name]
+	if !b {
+		return nil, fmt.Errorf("upstream %v was not found", name)
+	}
+	return d, nil
+}
+
+// dialAs dials as the user when the dialer routes by users
+func dialAs(d Dialer, id *Identity, network, addr string) (net.Conn, error) {
+	if v, b := d.(IdentityDialer); b {
+		return v.DialAs(id, network, addr)
+	}
+	return d.Dial(network, addr)
+}
+
+// Dial runs the CONNECT request of rfc1928 on a connection to the upstream
+func (d *socks5Dialer) Dial(network, addr string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, errUpstreamNetwork
+	}
+	req, err := connectRequest(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.forward.Dial("tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(DefaultDialTimeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := d.handshake(conn, req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (d *socks5Dialer) handshake(conn net.Conn, req []byte) error {
+	methods := []byte{socks5Version, 1, 0}
+	if d.auth != nil {
+		methods = []byte{socks5Version, 1, userPassAuth}
+	}
+	if _, err := conn.Write(methods); err != nil {
+		return err
+	}
+	selected := make([]byte, 2)
+	if _, err := io.ReadFull(conn, selected); err != nil {
+		return err
+	}
+	if selected[0] != socks5Version || selected[1] != methods[2] {
+		return errUpstreamMethod
+	}
+	if d.auth != nil {
+		auth := append([]byte{authVersion, byte(len(d.auth.Name))}, d.auth.Name...)
+		auth = append(append(auth, byte(len(d.auth.Pass))), d.auth.Pass...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, selected); err != nil {
+			return err
+		}
+		if selected[1] != success {
+			return errValidationFailed
+		}
+	}
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if _, err := readAddr(conn); err != nil {
+		return err
+	}
+	if reply[1] != repSucceeded {
+		return fmt.Errorf("upstream replied %v", reply[1])
+	}
+	return nil
+}
+
+// connectRequest encodes the CONNECT request of addr, hosts which are not ips are sent as domains
+func connectRequest(addr string) ([]byte, error) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return nil, err
+	}
+	req := []byte{socks5Version, cmdConnect, rsvRESERVED}
+	if ip := net.ParseIP(host); ip != nil {
+		return appendAddr(req, &net.TCPAddr{IP: ip, Port: port}), nil
+	}
+	if len(host) == 0 || len(host) > 255 {
+		return nil, fmt.Errorf("domain %v was wrong", host)
+	}
+	req = append(append(req, atypDomainName, byte(len(host))), host...)
+	return append(req, byte(port>>8), byte(port)), nil
+}
+
+// Dial sends a CONNECT request to the upstream
+func (d *httpDialer) Dial(network, addr string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, errUpstreamNetwork
+	}
+	conn, err := d.forward.Dial("tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.secret != nil {
+		secret := d.secret.Clone()
+		if secret.ServerName == "" {
+			secret.ServerName, _, _ = net.SplitHostPort(d.addr)
+		}
+		conn = tls.Client(conn, secret)
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if d.auth != nil {
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(d.auth.Name+":"+d.auth.Pass)))
+	}
+	if err := conn.SetDeadline(time.Now().Add(DefaultDialTimeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream replied %v", resp.Status)
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if r.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+	return conn, nil
+}
+
+// Read ...
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestRouter_Dial ...
+func TestRouter_Dial(t *testing.T) {
+	auth := &Auth{Name: "name", Pass: "pass"}
+	socksAddr, socksAccepted := listenProxy(t, Socks5, *auth)
+	httpAddr, httpAccepted := listenProxy(t, HTTP, *auth)
+	socks, err := NewUpstream(Socks5, socksAddr, auth, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpUpstream, err := NewUpstream(HTTP, httpAddr, auth, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo, other := echoTCP(t), echoTCP(t)
+	_, port, _ := net.SplitHostPort(echo)
+	router, err := NewRouter(map[string]Dialer{
+		"socks": socks,
+		"http":  httpUpstream,
+	}, []Route{
+		{Upstream: "socks", Hosts: []string{"127.0.0.1"}, Ports: []string{port}},
+		{Upstream: "direct", Users: []string{"name"}},
+	}, httpUpstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		id       *Identity
+		addr     string
+		accepted *int32
+	}{
+		{"route", Anonymous, echo, socksAccepted},
+		{"default", Anonymous, other, httpAccepted},
+		{"policy", &Identity{Policy: Policy{PolicyUpstream: "socks"}}, other, socksAccepted},
+		{"direct", &Identity{Name: "name"}, other, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, h := atomic.LoadInt32(socksAccepted), atomic.LoadInt32(httpAccepted)
+			conn, err := router.DialAs(tt.id, "tcp", tt.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+			if _, err := conn.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, 5)
+			if _, err := io.ReadFull(conn, got); err != nil || string(got) != "hello" {
+				t.Fatal("wrong echo", string(got), err)
+			}
+			s, h = atomic.LoadInt32(socksAccepted)-s, atomic.LoadInt32(httpAccepted)-h
+			if tt.accepted == nil && s+h != 0 || tt.accepted == socksAccepted && s != 1 || tt.accepted == httpAccepted && h != 1 {
+				t.Fatal("wrong upstream", s, h)
+			}
+		})
+	}
+	wrong, err := NewUpstream(Socks5, socksAddr, &Auth{Name: "name"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wrong.Dial("tcp", echo); err == nil {
+		t.Fatal("wrong pass was accepted by the upstream")
+	}
+}
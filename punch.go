@@ -0,0 +1,333 @@
+package lurker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"time"
+
+	"github.com/portmapping/go-reuse"
+	"github.com/portmapping/lurker/common"
+)
+
+// DefaultPunchInterval ...
+var DefaultPunchInterval = 500 * time.Millisecond
+
+// DefaultPunchPredict is the count of ports tried after the observed one,
+// many NATs allocate the ports of new mappings in sequence
+var DefaultPunchPredict = 3
+
+var errPunchFailed = errors.New("punch was failed")
+var errPunchNoPort = errors.New("no local port was bound, register or request first")
+var errPunchSameID = errors.New("peer id was the same as the local one")
+
+// Punch opens a direct tcp connection to the peer: the port used to talk to the server
+// is bound again for both listening and dialing, and both sides keep dialing the
+// observed and predicted addresses of each other until a simultaneous open succeeds
+func (s *source) Punch(peer Peer) (net.Conn, error) {
+	if !common.IsTCP(peer.Addr.Network()) {
+		return nil, fmt.Errorf("wrong peer network: %v", peer.Addr.Network())
+	}
+	if s.mappingPortTCP == 0 {
+		return nil, errPunchNoPort
+	}
+	//the roles are decided by the ids, equal ones would both wait for the other side
+	if s.service.ID == peer.ID {
+		return nil, errPunchSameID
+	}
+	local := common.LocalTCPAddr(s.mappingPortTCP).String()
+	lis, err := reuse.Listen("tcp", local)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	candidates := make(chan net.Conn)
+	go acceptPunch(ctx, lis, candidates)
+	go dialPunch(ctx, local, punchAddrs("tcp", peer), candidates)
+	log.Infow("punch", "peer", peer.ID, "local", local, "remote", peer.Addr.String())
+	if s.service.ID < peer.ID {
+		return s.initiatePunch(ctx, candidates)
+	}
+	return s.respondPunch(ctx, peer, candidates)
+}
+
+// punchAddrs returns the observed address of the peer, the predicted ports after it
+// and the advertised intranet addresses
+func punchAddrs(network string, peer Peer) []common.Addr {
+	var addrs []common.Addr
+	seen := make(map[string]bool)
+	add := func(addr common.Addr) {
+		if addr.IP == nil || addr.Port == 0 || seen[addr.String()] {
+			return
+		}
+		seen[addr.String()] = true
+		addrs = append(addrs, addr)
+	}
+	add(peer.Addr)
+	for i := 1; i <= DefaultPunchPredict && peer.Addr.Port+i <= 65535; i++ {
+		addr := peer.Addr
+		addr.Port += i
+		add(addr)
+	}
+	for _, addr := range peer.Service.Addr {
+		if common.IsTCP(network) && common.IsTCP(addr.Network()) ||
+			common.IsUDP(network) && common.IsUDP(addr.Network()) {
+			add(addr)
+		}
+	}
+	return addrs
+}
+
+func acceptPunch(ctx context.Context, lis net.Listener, candidates chan<- net.Conn) {
+	go func() {
+		<-ctx.Done()
+		lis.Close()
+	}()
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			log.Debugw("debug|acceptPunch|Accept", "error", err)
+			return
+		}
+		offerPunch(ctx, conn, candidates)
+	}
+}
+
+func dialPunch(ctx context.Context, local string, addrs []common.Addr, candidates chan<- net.Conn) {
+	t := time.NewTicker(DefaultPunchInterval)
+	defer t.Stop()
+	for {
+		for _, addr := range addrs {
+			go func(addr string) {
+				conn, err := reuse.DialTimeOut("tcp", local, addr, DefaultPunchInterval)
+				if err != nil {
+					log.Debugw("debug|dialPunch|DialTimeOut", "addr", addr, "error", err)
+					return
+				}
+				offerPunch(ctx, conn, candidates)
+			}(addr.String())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func offerPunch(ctx context.Context, conn net.Conn, candidates chan<- net.Conn) {
+	select {
+	case candidates <- conn:
+	case <-ctx.Done():
+		conn.Close()
+	}
+}
+
+// initiatePunch confirms the candidates one by one, so that the responder
+// receives the punch handshake on the single connection chosen here
+func (s *source) initiatePunch(ctx context.Context, candidates <-chan net.Conn) (net.Conn, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, errPunchFailed
+		case conn := <-candidates:
+			err := s.sendPunch(conn)
+			if err != nil {
+				log.Debugw("debug|initiatePunch|sendPunch", "error", err)
+				conn.Close()
+				continue
+			}
+			return conn, nil
+		}
+	}
+}
+
+func (s *source) sendPunch(conn net.Conn) error {
+	err := conn.SetDeadline(time.Now().Add(4 * DefaultPunchInterval))
+	if err != nil {
+		return err
+	}
+	req, err := EncodeHandshake(HandshakeHead{
+		Type: HandshakeTypePunch,
+	}, []byte(s.service.ID))
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	resp, err := ReadHandshakeResponse(conn)
+	if err != nil {
+		return err
+	}
+	if resp.Status != HandshakeStatusSuccess {
+		return fmt.Errorf("punch was refused: %s", resp.Data)
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// respondPunch waits on every candidate for the punch handshake of the peer
+func (s *source) respondPunch(ctx context.Context, peer Peer, candidates <-chan net.Conn) (net.Conn, error) {
+	results := make(chan net.Conn, 1)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, errPunchFailed
+		case conn := <-results:
+			return conn, nil
+		case conn := <-candidates:
+			go func() {
+				if err := s.receivePunch(ctx, conn, peer); err != nil {
+					log.Debugw("debug|respondPunch|receivePunch", "error", err)
+					conn.Close()
+					return
+				}
+				if ctx.Err() != nil {
+					conn.Close()
+					return
+				}
+				select {
+				case results <- conn:
+				default:
+					conn.Close()
+				}
+			}()
+		}
+	}
+}
+
+func (s *source) receivePunch(ctx context.Context, conn net.Conn, peer Peer) error {
+	deadline, _ := ctx.Deadline()
+	err := conn.SetDeadline(deadline)
+	if err != nil {
+		return err
+	}
+	h, data, err := ReadHandshake(conn)
+	if err != nil {
+		return err
+	}
+	status := HandshakeStatusSuccess
+	if h.Type != HandshakeTypePunch || string(data) != peer.ID {
+		status = HandshakeStatusFailed
+	}
+	resp, err := EncodeHandshakeResponse(h.Version, &HandshakeResponse{
+		Status: status,
+		Data:   []byte(s.service.ID),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(resp); err != nil {
+		return err
+	}
+	if status != HandshakeStatusSuccess {
+		return fmt.Errorf("wrong punch from: %s", data)
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// PunchUDP opens a udp hole to the peer from the port used to talk to the server
+// and upgrades it to a reliable kcp session which keeps the nat binding alive
+func (s *source) PunchUDP(peer Peer) (net.Conn, error) {
+	if !common.IsUDP(peer.Addr.Network()) {
+		return nil, fmt.Errorf("wrong peer network: %v", peer.Addr.Network())
+	}
+	if s.mappingPortUDP == 0 {
+		return nil, errPunchNoPort
+	}
+	if s.service.ID == peer.ID {
+		return nil, errPunchSameID
+	}
+	local := common.LocalUDPAddr(s.mappingPortUDP).String()
+	conn, err := reuse.ListenPacket("udp", local)
+	if err != nil {
+		return nil, err
+	}
+	log.Infow("punch udp", "peer", peer.ID, "local", local, "remote", peer.Addr.String())
+	remote, err := s.punchUDP(conn, peer)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newKCPConn(conn, remote, punchConv(s.service.ID, peer.ID))
+}
+
+// punchUDP sends the punch handshake to all addresses of the peer
+// until the peer has answered ours and we have answered the one of the peer
+func (s *source) punchUDP(conn net.PacketConn, peer Peer) (net.Addr, error) {
+	req, err := EncodeHandshake(HandshakeHead{
+		Type: HandshakeTypePunch,
+	}, []byte(s.service.ID))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := EncodeHandshakeResponse(CurrentVersion, &HandshakeResponse{
+		Status: HandshakeStatusSuccess,
+		Data:   []byte(s.service.ID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var addrs []net.Addr
+	for _, addr := range punchAddrs("udp", peer) {
+		addrs = append(addrs, addr.UDP())
+	}
+
+	deadline := time.Now().Add(s.timeout)
+	data := make([]byte, maxByteSize)
+	var remote net.Addr
+	answered, acked := false, false
+	for !answered || !acked {
+		if time.Now().After(deadline) {
+			return nil, errPunchFailed
+		}
+		if !acked {
+			for _, addr := range addrs {
+				if _, err := conn.WriteTo(req, addr); err != nil {
+					log.Debugw("debug|punchUDP|WriteTo", "addr", addr.String(), "error", err)
+				}
+			}
+		}
+		err := conn.SetReadDeadline(time.Now().Add(DefaultPunchInterval))
+		if err != nil {
+			return nil, err
+		}
+		for {
+			n, addr, err := conn.ReadFrom(data)
+			if err != nil {
+				break
+			}
+			if n > 0 && data[0] == uint8(HandshakeTypePunch) {
+				h, id, err := DecodeHandshake(data[:n])
+				if err != nil || h.Type != HandshakeTypePunch || string(id) != peer.ID {
+					continue
+				}
+				//the answer may be lost while the peer is already talking kcp, send it more than once
+				for i := 0; i < 3; i++ {
+					if _, err := conn.WriteTo(resp, addr); err != nil {
+						log.Debugw("debug|punchUDP|WriteTo", "addr", addr.String(), "error", err)
+					}
+				}
+				remote, answered = addr, true
+				continue
+			}
+			r, err := DecodeHandshakeResponse(data[:n])
+			if err != nil || r.Status != HandshakeStatusSuccess || string(r.Data) != peer.ID {
+				continue
+			}
+			remote, acked = addr, true
+		}
+	}
+	return remote, conn.SetReadDeadline(time.Time{})
+}
+
+// punchConv returns the same kcp conversation id on both sides
+func punchConv(id1, id2 string) uint32 {
+	if id2 < id1 {
+		id1, id2 = id2, id1
+	}
+	return crc32.ChecksumIEEE([]byte(id1 + id2))
+}
@@ -0,0 +1,132 @@
+package lurker
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/portmapping/lurker/common"
+)
+
+// TestSource_Punch ...
+func TestSource_Punch(t *testing.T) {
+	a := &source{
+		service:        Service{ID: "a"},
+		mappingPortTCP: freeTCPPort(t),
+		timeout:        5 * time.Second,
+	}
+	b := &source{
+		service:        Service{ID: "b"},
+		mappingPortTCP: freeTCPPort(t),
+		timeout:        5 * time.Second,
+	}
+	peer := func(s *source) Peer {
+		return Peer{
+			ID:   s.service.ID,
+			Addr: *common.ParseSourceAddr("tcp", net.IPv4(127, 0, 0, 1), s.mappingPortTCP),
+		}
+	}
+
+	conns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := b.Punch(peer(a))
+		if err != nil {
+			t.Log(err)
+		}
+		conns <- conn
+	}()
+	ca, err := a.Punch(peer(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ca.Close()
+	cb := <-conns
+	if cb == nil {
+		t.Fatal("b was not connected")
+	}
+	defer cb.Close()
+
+	if _, err := ca.Write([]byte("punch")); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 5)
+	if err := cb.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cb.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "punch" {
+		t.Fatal("wrong data", string(data))
+	}
+}
+
+// TestPunchAddrs ...
+func TestPunchAddrs(t *testing.T) {
+	addrs := punchAddrs("tcp", Peer{Addr: *common.ParseSourceAddr("tcp", net.IPv4(127, 0, 0, 1), 65534)})
+	if len(addrs) != 2 || addrs[1].Port != 65535 {
+		t.Fatal("wrong predicted ports", addrs)
+	}
+	s := &source{
+		service:        Service{ID: "a"},
+		mappingPortTCP: freeTCPPort(t),
+		timeout:        time.Second,
+	}
+	if _, err := s.Punch(Peer{ID: "a", Addr: addrs[0]}); err != errPunchSameID {
+		t.Fatal("same id was punched", err)
+	}
+}
+
+// TestSource_PunchUDP ...
+func TestSource_PunchUDP(t *testing.T) {
+	a := &source{
+		service:        Service{ID: "a"},
+		mappingPortUDP: freeUDPPort(t),
+		timeout:        5 * time.Second,
+	}
+	b := &source{
+		service:        Service{ID: "b"},
+		mappingPortUDP: freeUDPPort(t),
+		timeout:        5 * time.Second,
+	}
+	peer := func(s *source) Peer {
+		return Peer{
+			ID:   s.service.ID,
+			Addr: *common.ParseSourceAddr("udp", net.IPv4(127, 0, 0, 1), s.mappingPortUDP),
+		}
+	}
+
+	conns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := b.PunchUDP(peer(a))
+		if err != nil {
+			t.Log(err)
+		}
+		conns <- conn
+	}()
+	ca, err := a.PunchUDP(peer(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ca.Close()
+	cb := <-conns
+	if cb == nil {
+		t.Fatal("b was not connected")
+	}
+	defer cb.Close()
+
+	if _, err := ca.Write([]byte("punch")); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 5)
+	if err := cb.SetReadDeadline(time.Now().Add(3 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(cb, data); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "punch" {
+		t.Fatal("wrong data", string(data))
+	}
+}
@@ -0,0 +1,322 @@
+package lurker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/portmapping/lurker/common"
+	"github.com/portmapping/lurker/pool"
+)
+
+// DefaultRelayTimeout is the time an allocation waits for the peer to join
+var DefaultRelayTimeout = 10 * time.Second
+
+// DefaultRelayIdle closes the relayed connections without traffic in both directions
+var DefaultRelayIdle = 5 * time.Minute
+
+var errConnectorHijacked = errors.New("connector was hijacked")
+
+// hijacker is a connector whose connection can be taken over
+type hijacker interface {
+	hijack() net.Conn
+}
+
+// hijackedConn releases its connector when the relay closes it
+type hijackedConn struct {
+	net.Conn
+	connector *tcpConnector
+}
+
+// relaySession pipes the connection of the allocating peer to the one of the joining peer
+type relaySession struct {
+	//the counters are kept first for the 64 bit alignment of atomic
+	fromBytes int64
+	toBytes   int64
+	last      int64
+	token     string
+	from      string
+	to        string
+	idle      time.Duration
+	connector Connector
+	claimed   sync.Once
+	closed    sync.Once
+	conns     [2]net.Conn
+}
+
+type relayConn struct {
+	net.Conn
+	session *relaySession
+	n       *int64
+}
+
+// Relay connects to the peer through the server: without a session an allocation is requested
+// and the peer is notified, with the session received from Register the allocation is joined
+func (s *source) Relay(peer Peer) (net.Conn, error) {
+	if s.service.ID == "" {
+		s.service.ID = GlobalID
+	}
+	var conn net.Conn
+	var err error
+	switch s.addr.Network() {
+	case "tcp", "tcp4", "tcp6":
+		//the mapping port may be connected to the server by Register already
+		conn, err = s.dialTCP(0)
+		if err == nil {
+			conn = s.secure(conn)
+		}
+	case "kcp":
+		conn, err = dialKCP(s.addr.UDP())
+	default:
+		return nil, fmt.Errorf("relay was not supported on network %v", s.addr.Network())
+	}
+	if err != nil {
+		return nil, err
+	}
+	req, err := json.Marshal(RendezvousRequest{
+		Target: peer.ID,
+		Peer: Peer{
+			ID:      s.service.ID,
+			Service: s.service,
+			Session: peer.Session,
+		},
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := s.authorize(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := handshake(s, conn, HandshakeTypeRelay, req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Dial requests the address of the peer and connects to it, punching is tried first
+// unless Connect fell back to the relay or the nats of both sides can not be punched, then the server relays
+func (s *source) Dial(id string) (net.Conn, error) {
+	peer, err := s.Request(id)
+	if err != nil {
+		return nil, err
+	}
+	if s.support.Chosen != StrategyRelay && s.support.Strategy(peer.Service.NAT) != StrategyRelay {
+		conn, err := s.punch(peer)
+		if err == nil {
+			return s.seal(conn, id, true)
+		}
+		log.Debugw("debug|Dial|punch", "error", err)
+	}
+	conn, err := s.Relay(peer)
+	if err != nil {
+		return nil, err
+	}
+	return s.seal(conn, id, true)
+}
+
+// Accept connects to a peer received from Register in the way the peer asked for
+func (s *source) Accept(peer Peer) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if peer.Session != "" {
+		conn, err = s.Relay(peer)
+	} else {
+		conn, err = s.punch(peer)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.seal(conn, peer.ID, false)
+}
+
+func (s *source) punch(peer Peer) (net.Conn, error) {
+	if common.IsUDP(peer.Addr.Network()) {
+		return s.PunchUDP(peer)
+	}
+	return s.Punch(peer)
+}
+
+// relay allocates a session for the requesting connector or joins the allocated one
+func (s *subject) relay(connector Connector, data []byte) {
+	var r RendezvousRequest
+	err := json.Unmarshal(data, &r)
+	if err != nil {
+		log.Debugw("debug|relay|Unmarshal", "error", err)
+		s.refuse(connector, "wrong relay request")
+		return
+	}
+	if r.Peer.Session == "" {
+		s.allocate(connector, r)
+		return
+	}
+	s.join(connector, r)
+}
+
+func (s *subject) allocate(connector Connector, r RendezvousRequest) {
+	v, b := s.connectors.Load(r.Target)
+	if !b {
+		s.refuse(connector, "peer was not found")
+		return
+	}
+	target := v.(*subjectPeer)
+	session := &relaySession{
+		token:     UUID(),
+		from:      r.Peer.ID,
+		to:        r.Target,
+		idle:      DefaultRelayIdle,
+		connector: connector,
+	}
+	s.sessions.Store(session.token, session)
+	notify := r.Peer
+	notify.Session = session.token
+	err := target.connector.Reply(HandshakeStatusSuccess, notify.JSON())
+	if err != nil {
+		log.Debugw("debug|allocate|Reply", "id", r.Target, "error", err)
+		s.sessions.Delete(session.token)
+		s.remove(r.Target, target.connector)
+		s.refuse(connector, "peer was offline")
+		return
+	}
+	log.Infow("relay allocated", "from", r.Peer.ID, "to", r.Target, "session", session.token)
+	time.AfterFunc(DefaultRelayTimeout, func() {
+		if session.claim() {
+			s.sessions.Delete(session.token)
+			s.refuse(connector, "peer was not joined")
+		}
+	})
+}
+
+func (s *subject) join(connector Connector, r RendezvousRequest) {
+	v, b := s.sessions.Load(r.Peer.Session)
+	if !b {
+		s.refuse(connector, "session was not found")
+		return
+	}
+	session := v.(*relaySession)
+	if session.to != r.Peer.ID {
+		s.refuse(connector, "session was not allocated to the peer")
+		return
+	}
+	if !session.claim() {
+		s.refuse(connector, "session was expired")
+		return
+	}
+	s.sessions.Delete(session.token)
+	err := session.connector.Reply(HandshakeStatusSuccess, []byte(session.token))
+	if err != nil {
+		log.Debugw("debug|join|Reply", "error", err)
+		s.refuse(session.connector, "")
+		s.refuse(connector, "peer was offline")
+		return
+	}
+	err = connector.Reply(HandshakeStatusSuccess, []byte(session.token))
+	if err != nil {
+		log.Debugw("debug|join|Reply", "error", err)
+		s.refuse(session.connector, "peer was offline")
+		s.refuse(connector, "")
+		return
+	}
+	session.start(session.connector.(hijacker).hijack(), connector.(hijacker).hijack())
+}
+
+// refuse replies the failure to a hijacked connector and closes its connection
+func (s *subject) refuse(connector Connector, msg string) {
+	if msg != "" {
+		s.reply(connector, HandshakeStatusFailed, []byte(msg))
+	}
+	if h, b := connector.(hijacker); b {
+		h.hijack().Close()
+	}
+}
+
+// claim returns true only once, for either the joining peer or the timeout
+func (r *relaySession) claim() (b bool) {
+	r.claimed.Do(func() {
+		b = true
+	})
+	return b
+}
+
+func (r *relaySession) start(from, to net.Conn) {
+	r.conns = [2]net.Conn{from, to}
+	for _, conn := range r.conns {
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			log.Debugw("debug|relay|SetDeadline", "error", err)
+			r.close()
+			return
+		}
+	}
+	r.touch()
+	log.Infow("relay started", "from", r.from, "to", r.to, "session", r.token)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	pool.AddConnections(pool.NewConnection(
+		&relayConn{Conn: from, session: r, n: &r.fromBytes},
+		&relayConn{Conn: to, session: r, n: &r.toBytes},
+		wg,
+	))
+	go func() {
+		wg.Wait()
+		r.close()
+		log.Infow("relay finished", "session", r.token,
+			"from", r.from, "from_bytes", atomic.LoadInt64(&r.fromBytes),
+			"to", r.to, "to_bytes", atomic.LoadInt64(&r.toBytes))
+	}()
+}
+
+func (r *relaySession) touch() {
+	atomic.StoreInt64(&r.last, time.Now().UnixNano())
+}
+
+func (r *relaySession) idled() bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&r.last))) >= r.idle
+}
+
+func (r *relaySession) close() {
+	r.closed.Do(func() {
+		for _, conn := range r.conns {
+			conn.Close()
+		}
+	})
+}
+
+// Close ...
+func (c *hijackedConn) Close() error {
+	return c.connector.release()
+}
+
+// Read counts the bytes sent by the peer, the read only times out when
+// neither direction has moved for the idle time
+func (c *relayConn) Read(p []byte) (int, error) {
+	for {
+		err := c.Conn.SetReadDeadline(time.Now().Add(c.session.idle))
+		if err != nil {
+			c.session.close()
+			return 0, err
+		}
+		n, err := c.Conn.Read(p)
+		if n > 0 {
+			atomic.AddInt64(c.n, int64(n))
+			c.session.touch()
+		}
+		if e, b := err.(net.Error); b && e.Timeout() && n == 0 && !c.session.idled() {
+			continue
+		}
+		if err != nil {
+			//the copy of the other direction is ended by closing both sides
+			c.session.close()
+		}
+		return n, err
+	}
+}
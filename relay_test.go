@@ -0,0 +1,100 @@
+package lurker
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/portmapping/lurker/common"
+)
+
+// TestSource_Relay ...
+func TestSource_Relay(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.NAT = false
+	cfg.TCP = freeTCPPort(t)
+	l := New(cfg)
+	l.RegisterListener("tcp", NewTCPListener(cfg))
+	c, err := l.Listen(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range c {
+		}
+	}()
+
+	addr := *common.ParseSourceAddr("tcp", net.IPv4(127, 0, 0, 1), cfg.TCP)
+	target := NewSource(Service{ID: "target"}, addr)
+	peers, err := target.Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := NewSource(Service{ID: "requester"}, addr).Relay(Peer{ID: "target"})
+		if err != nil {
+			t.Log(err)
+		}
+		conns <- conn
+	}()
+	var p Peer
+	select {
+	case p = <-peers:
+	case <-time.After(3 * time.Second):
+		t.Fatal("relay was not notified")
+	}
+	if p.ID != "requester" || p.Session == "" {
+		t.Fatal("wrong requester", p)
+	}
+	ct, err := target.Accept(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ct.Close()
+	cr := <-conns
+	if cr == nil {
+		t.Fatal("requester was not relayed")
+	}
+	defer cr.Close()
+
+	for _, pair := range [][2]net.Conn{{cr, ct}, {ct, cr}} {
+		if _, err := pair[0].Write([]byte("relay")); err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, 5)
+		if err := pair[1].SetReadDeadline(time.Now().Add(3 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(pair[1], data); err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "relay" {
+			t.Fatal("wrong data", string(data))
+		}
+	}
+
+	if _, err := NewSource(Service{ID: "other"}, addr).Accept(p); err == nil {
+		t.Fatal("claimed session was joined")
+	}
+
+	//the relayed connectors are still tracked, the shutdown closes them when ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := l.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatal("relay was not waited for", err)
+	}
+	if err := cr.SetReadDeadline(time.Now().Add(3 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cr.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatal("relay was not closed", err)
+	}
+}
+
+func isTimeout(err error) bool {
+	e, b := err.(net.Error)
+	return b && e.Timeout()
+}
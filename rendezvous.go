@@ -0,0 +1,198 @@
+package lurker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/portmapping/go-reuse"
+	"github.com/portmapping/lurker/common"
+)
+
+// DefaultKeepAlive ...
+var DefaultKeepAlive = 20 * time.Second
+
+// Peer ...
+type Peer struct {
+	ID      string      `json:"id"`
+	Addr    common.Addr `json:"addr"`
+	Service Service     `json:"service"`
+	Session string      `json:"session,omitempty"`
+}
+
+// RendezvousRequest ...
+type RendezvousRequest struct {
+	Target string `json:"target"`
+	Peer   Peer   `json:"peer"`
+}
+
+// JSON ...
+func (p Peer) JSON() []byte {
+	marshal, err := json.Marshal(p)
+	if err != nil {
+		return nil
+	}
+	return marshal
+}
+
+// ParsePeer ...
+func ParsePeer(data []byte) (Peer, error) {
+	var p Peer
+	err := json.Unmarshal(data, &p)
+	if err != nil {
+		return Peer{}, err
+	}
+	return p, nil
+}
+
+// Register keeps a connection to the server and receives the peers which want to connect
+func (s *source) Register() (<-chan Peer, error) {
+	conn, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	s.service.KeepConnect = true
+	if _, err := connect(s, conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	peers := make(chan Peer, 5)
+	done := make(chan struct{})
+	go keepAlive(conn, done)
+	go func() {
+		defer func() {
+			close(done)
+			close(peers)
+			conn.Close()
+		}()
+		for {
+			resp, err := readHandshakeResponse(conn)
+			if err != nil {
+				log.Debugw("debug|Register|readHandshakeResponse", "error", err)
+				return
+			}
+			if resp.Status != HandshakeStatusSuccess {
+				continue
+			}
+			p, err := ParsePeer(resp.Data)
+			if err != nil {
+				//pong of keep alive
+				continue
+			}
+			peers <- p
+		}
+	}()
+	return peers, nil
+}
+
+// Request asks the server to exchange the addresses with the peer of id
+func (s *source) Request(id string) (Peer, error) {
+	conn, err := s.dial()
+	if err != nil {
+		return Peer{}, err
+	}
+	defer conn.Close()
+	req, err := json.Marshal(RendezvousRequest{
+		Target: id,
+		Peer: Peer{
+			ID:      s.service.ID,
+			Service: s.service,
+		},
+	})
+	if err != nil {
+		return Peer{}, err
+	}
+	if err := s.authorize(conn); err != nil {
+		return Peer{}, err
+	}
+	resp, err := handshake(s, conn, HandshakeTypeAdapter, req)
+	if err != nil {
+		return Peer{}, err
+	}
+	return ParsePeer(resp.Data)
+}
+
+// dial connects to the source from the mapping port and
+// records the port used so that later punching binds the same one
+func (s *source) dial() (conn net.Conn, err error) {
+	if s.service.ID == "" {
+		s.service.ID = GlobalID
+	}
+	switch s.addr.Network() {
+	case "tcp", "tcp4", "tcp6":
+		conn, err = s.dialTCP(s.mappingPortTCP)
+		if err != nil {
+			return nil, err
+		}
+		//the local port of a chained connection is the one of the upstream and is not mapped
+		if s.dialer == nil {
+			s.mappingPortTCP = conn.LocalAddr().(*net.TCPAddr).Port
+			s.service.PortTCP = s.mappingPortTCP
+		}
+		conn = s.secure(conn)
+	case "udp", "udp4", "udp6":
+		conn, err = reuse.DialUDP(s.addr.Network(), common.LocalUDPAddr(s.mappingPortUDP), s.addr.UDP())
+		if err != nil {
+			return nil, err
+		}
+		s.mappingPortUDP = conn.LocalAddr().(*net.UDPAddr).Port
+		s.service.PortUDP = s.mappingPortUDP
+	case "kcp":
+		conn, err = dialKCP(s.addr.UDP())
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("network %v was not supported", s.addr.Network())
+	}
+	if s.service.Addr == nil {
+		s.service.Addr = localAddrs(s.addr.Network(), conn.LocalAddr())
+	}
+	return conn, nil
+}
+
+// localAddrs lists the interface addresses with the port of addr,
+// peers in the same intranet can reach each other on them
+func localAddrs(network string, addr net.Addr) []common.Addr {
+	_, port := common.ParseAddr(addr.String())
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var list []common.Addr
+	for _, a := range addrs {
+		ipNet, b := a.(*net.IPNet)
+		if !b || ipNet.IP.IsLoopback() || ipNet.IP.To4() == nil {
+			continue
+		}
+		list = append(list, *common.ParseSourceAddr(network, ipNet.IP, port))
+	}
+	return list
+}
+
+func keepAlive(conn net.Conn, done <-chan struct{}) {
+	t := time.NewTicker(DefaultKeepAlive)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			ping, err := EncodeHandshake(HandshakeHead{
+				Type: HandshakeTypePing,
+			}, nil)
+			if err != nil {
+				return
+			}
+			if _, err := conn.Write(ping); err != nil {
+				log.Debugw("debug|keepAlive|Write", "error", err)
+				return
+			}
+		}
+	}
+}
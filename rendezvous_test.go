@@ -0,0 +1,66 @@
+package lurker
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/portmapping/lurker/common"
+)
+
+func freeTCPPort(t *testing.T) int {
+	l, err := net.ListenTCP("tcp", common.LocalTCPAddr(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// TestSource_Request ...
+func TestSource_Request(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.NAT = false
+	cfg.TCP = freeTCPPort(t)
+	l := New(cfg)
+	l.RegisterListener("tcp", NewTCPListener(cfg))
+	c, err := l.Listen(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range c {
+		}
+	}()
+
+	addr := *common.ParseSourceAddr("tcp", net.IPv4(127, 0, 0, 1), cfg.TCP)
+	target := NewSource(Service{ID: "target"}, addr)
+	peers, err := target.Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//a one-shot connect of the same id does not replace the registered connector
+	if err := tryConnect(NewSource(Service{ID: "target"}, addr).(*source), &addr); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewSource(Service{ID: "requester"}, addr).Request("target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ID != "target" || p.Addr.Port == 0 {
+		t.Fatal("wrong target", p)
+	}
+	select {
+	case p := <-peers:
+		if p.ID != "requester" || p.Addr.Port == 0 {
+			t.Fatal("wrong requester", p)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("requester was not received")
+	}
+
+	if _, err := NewSource(Service{ID: "requester"}, addr).Request("unknown"); err == nil {
+		t.Fatal("unknown peer was found")
+	}
+}
@@ -0,0 +1,158 @@
+package lurker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/portmapping/go-reuse"
+)
+
+// DefaultCertificateValidity ...
+var DefaultCertificateValidity = 365 * 24 * time.Hour
+
+var errCertificateID = errors.New("certificate was not issued to the id")
+
+// Secret loads the certificate, key and ca files into the tls config shared by the listeners and sources,
+// the key may be kept in the certificate file. With VerifyClient the listeners require certificates
+// signed by the ca, the common name or a dns name of which must be the id in the handshakes
+func (c *Config) Secret() (*tls.Config, error) {
+	if c.secret != nil {
+		return c.secret, nil
+	}
+	secret := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if c.Certificate != "" {
+		key := c.Key
+		if key == "" {
+			key = c.Certificate
+		}
+		cert, err := tls.LoadX509KeyPair(c.Certificate, key)
+		if err != nil {
+			return nil, err
+		}
+		secret.Certificates = []tls.Certificate{cert}
+	}
+	if c.CA != "" {
+		data, err := ioutil.ReadFile(c.CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate was found in ca %v", c.CA)
+		}
+		secret.RootCAs = pool
+		secret.ClientCAs = pool
+	}
+	if c.VerifyClient {
+		if secret.ClientCAs == nil {
+			return nil, errors.New("ca was required by verify_client")
+		}
+		secret.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	c.secret = secret
+	return secret, nil
+}
+
+// SetSecret sets the tls config of the connections to the source, nil connects without tls
+func (s *source) SetSecret(secret *tls.Config) {
+	s.secret = secret
+}
+
+// secure starts the client side of tls on the stream connected to the source
+func (s *source) secure(conn net.Conn) net.Conn {
+	if s.secret == nil {
+		return conn
+	}
+	secret := s.secret.Clone()
+	if secret.ServerName == "" {
+		secret.ServerName = s.addr.IP.String()
+	}
+	return tls.Client(conn, secret)
+}
+
+// listenTLS ...
+func listenTLS(cfg *Config, addr string) (net.Listener, error) {
+	secret, err := cfg.Secret()
+	if err != nil {
+		return nil, err
+	}
+	return reuse.ListenTLS("tcp", addr, secret)
+}
+
+// verifyID checks that the verified client certificate of the connection was issued to the id,
+// connections without a verified certificate are left to the tls config
+func verifyID(conn net.Conn, id string) error {
+	tc, b := conn.(*tls.Conn)
+	if !b {
+		return nil
+	}
+	chains := tc.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil
+	}
+	cert := chains[0][0]
+	if cert.Subject.CommonName == id {
+		return nil
+	}
+	for _, name := range cert.DNSNames {
+		if name == id {
+			return nil
+		}
+	}
+	return errCertificateID
+}
+
+// GenerateCertificate returns a self-signed certificate and its key in pem, the common name is the id
+// and the hosts are added as ip or dns names. The certificate signs itself so it can be used as the ca
+func GenerateCertificate(id string, hosts ...string) (cert []byte, key []byte, err error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: id},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(DefaultCertificateValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	key = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return cert, key, nil
+}
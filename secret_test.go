@@ -0,0 +1,83 @@
+package lurker
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/portmapping/lurker/common"
+)
+
+func writeCertificate(t *testing.T, dir string, id string, hosts ...string) string {
+	cert, key, err := GenerateCertificate(id, hosts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, id+".pem")
+	if err := ioutil.WriteFile(path, append(cert, key...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestConfig_Secret ...
+func TestConfig_Secret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lurker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server := writeCertificate(t, dir, "server", "127.0.0.1")
+	client := writeCertificate(t, dir, "client")
+
+	cfg := DefaultConfig()
+	cfg.NAT = false
+	cfg.TCP = freeTCPPort(t)
+	cfg.UseSecret = true
+	cfg.Certificate = server
+	cfg.CA = client
+	cfg.VerifyClient = true
+	l := New(cfg)
+	l.RegisterListener("tcp", NewTCPListener(cfg))
+	c, err := l.Listen(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	go func() {
+		for range c {
+		}
+	}()
+
+	secret, err := (&Config{Certificate: client, CA: server}).Secret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := *common.ParseSourceAddr("tcp", net.IPv4(127, 0, 0, 1), cfg.TCP)
+	s := NewSource(Service{ID: "client"}, addr)
+	s.SetSecret(secret)
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = NewSource(Service{ID: "other"}, addr)
+	s.SetSecret(secret)
+	if err := s.Connect(); err == nil {
+		t.Fatal("certificate of another id was accepted")
+	}
+	if err := NewSource(Service{ID: "client"}, addr).Connect(); err == nil {
+		t.Fatal("connection without tls was accepted")
+	}
+	untrusted, err := (&Config{CA: server}).Secret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = NewSource(Service{ID: "client"}, addr)
+	s.SetSecret(untrusted)
+	if err := s.Connect(); err == nil {
+		t.Fatal("connection without client certificate was accepted")
+	}
+}
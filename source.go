@@ -1,23 +1,45 @@
 package lurker
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"time"
 
+	"github.com/flynn/noise"
 	"github.com/portmapping/go-reuse"
 	"github.com/portmapping/lurker/common"
-	"github.com/xtaci/kcp-go/v5"
+	"github.com/portmapping/lurker/proxy"
+	"github.com/portmapping/lurker/stun"
 )
 
+var errTryFailed = errors.New("all try connect is failed")
+var errTryTimeout = errors.New("try connect was timeout")
+
 // Source ...
 type Source interface {
 	Connect() error
-	Try() error
+	Register() (<-chan Peer, error)
+	Request(id string) (Peer, error)
+	Punch(peer Peer) (net.Conn, error)
+	PunchUDP(peer Peer) (net.Conn, error)
+	Relay(peer Peer) (net.Conn, error)
+	Dial(id string) (net.Conn, error)
+	Accept(peer Peer) (net.Conn, error)
+	DialSession(id string) (Session, error)
+	AcceptSession(peer Peer) (Session, error)
+	Try() (Support, error)
+	Detect(servers ...string) (*stun.Result, error)
+	Support() Support
 	Service() Service
 	Addr() common.Addr
 	SetMappingPort(string, int) //T.B.D
+	SetSecret(secret *tls.Config)
+	SetAuthKey(key string)
+	SetNoiseKey(key noise.DHKey)
+	SetDialer(dialer proxy.Dialer)
 }
 
 type source struct {
@@ -27,6 +49,10 @@ type source struct {
 	addr           common.Addr
 	support        Support
 	timeout        time.Duration
+	secret         *tls.Config
+	authKey        string
+	noiseKey       *noise.DHKey
+	dialer         proxy.Dialer
 }
 
 // SetMappingPort ...
@@ -39,6 +65,26 @@ func (s *source) SetMappingPort(network string, i int) {
 	}
 }
 
+// SetDialer chains the tcp connections to the source through the dialer, nil connects directly
+func (s *source) SetDialer(dialer proxy.Dialer) {
+	if dialer == proxy.Direct {
+		dialer = nil
+	}
+	s.dialer = dialer
+}
+
+// dialTCP connects to the source through the dialer when set, otherwise from the local port
+// or from any port when lport is 0
+func (s *source) dialTCP(lport int) (net.Conn, error) {
+	if s.dialer != nil {
+		return s.dialer.Dial("tcp", s.addr.String())
+	}
+	if lport == 0 {
+		return net.DialTimeout(s.addr.Network(), s.addr.String(), s.timeout)
+	}
+	return reuse.DialTimeOut(s.addr.Network(), common.LocalTCPAddr(lport).String(), s.addr.String(), s.timeout)
+}
+
 // service ...
 func (s source) Service() Service {
 	return s.service
@@ -49,6 +95,32 @@ func (s source) Addr() common.Addr {
 	return s.addr
 }
 
+// Support ...
+func (s source) Support() Support {
+	return s.support
+}
+
+// Detect classifies the nat in front of the udp mapping port with the stun servers,
+// the result is advertised to peers with the service
+func (s *source) Detect(servers ...string) (*stun.Result, error) {
+	conn, err := reuse.ListenPacket("udp", common.LocalUDPAddr(s.mappingPortUDP).String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	r, err := stun.NewClient(servers...).Discover(conn)
+	if err != nil {
+		log.Debugw("debug|Detect|Discover", "error", err)
+		return nil, err
+	}
+	if s.mappingPortUDP == 0 {
+		s.mappingPortUDP = conn.LocalAddr().(*net.UDPAddr).Port
+	}
+	s.support.NAT = *r
+	s.service.NAT = r.NAT
+	return r, nil
+}
+
 // JSON ...
 func (s Service) JSON() []byte {
 	marshal, err := json.Marshal(s)
@@ -72,27 +144,145 @@ func (s source) String() string {
 	return s.addr.String()
 }
 
-// Try ...
-func (s *source) Try() error {
+// Try connects to the source in every way the nat supports at once with a deadline of the
+// connection timeout, the first connection answering the ping wins and is kept in the report
+// with the strategy chosen from it. Every attempt finished before the deadline is recorded
+func (s *source) Try() (Support, error) {
 	log.Infow("connect to", "ip", s.addr.String())
-	defer func() {
-		fmt.Println("supported", s.support.List)
-	}()
-	var err error
-	//var common *Addr
-	if err = tryPublicNetworkConnect(s); err != nil {
-		log.Debugw("debug|tryPublicNetworkConnect|error")
+	support := Support{
+		NAT:     s.support.NAT,
+		Network: NetworkSupportMax,
+	}
+	attempts := tryAttempts(s)
+	results := make(chan tryResult, len(attempts))
+	for _, attempt := range attempts {
+		go func(attempt tryAttempt) {
+			start := time.Now()
+			conn, err := attempt.try(s, attempt.addr)
+			results <- tryResult{
+				network: attempt.network,
+				conn:    conn,
+				latency: time.Since(start),
+				err:     err,
+			}
+		}(attempt)
+	}
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	for pending := len(attempts); pending > 0; pending-- {
+		select {
+		case r := <-results:
+			if r.err != nil {
+				log.Debugw("debug|Try|try", "network", r.network, "error", r.err)
+				support.Latency[r.network], support.Errors[r.network] = r.latency, r.err
+				continue
+			}
+			support.add(r.network, r.latency)
+			if support.Conn != nil {
+				//the later connections are only reported
+				r.conn.Close()
+				continue
+			}
+			support.Network, support.Conn = r.network, r.conn
+		case <-timer.C:
+			go closeTryResults(results, pending)
+			return s.tried(&support, errTryTimeout)
+		}
+	}
+	return s.tried(&support, errTryFailed)
+}
+
+// tried chooses the strategy of the report, err is returned when nothing was connected
+func (s *source) tried(support *Support, err error) (Support, error) {
+	s.choose(support)
+	if support.Conn == nil {
+		return *support, err
 	}
+	return *support, nil
+}
 
-	if err := tryReverseNetworkConnect(s); err != nil {
-		log.Debugw("debug|tryReverseNetworkConnect|error", "error", err)
+// choose records the report with the strategy picked from it, when nothing was connected
+// the nat is detected unless known, so the strategy tells whether to punch or to relay
+func (s *source) choose(support *Support) {
+	if support.Network == NetworkSupportMax && support.NAT.NAT == stun.BehaviorUnknown {
+		r, err := s.Detect()
+		if err != nil {
+			log.Debugw("debug|Try|Detect", "error", err)
+		} else {
+			support.NAT = *r
+		}
 	}
+	//the nat of the other side is not known before it is requested from the server
+	support.Chosen = support.Strategy(stun.BehaviorUnknown)
+	log.Infow("strategy chosen", "nat", support.NAT.String(), "strategy", support.Chosen.String())
+	s.support = *support
+}
+
+type tryAttempt struct {
+	network int
+	addr    *common.Addr
+	try     func(s *source, addr *common.Addr) (net.Conn, error)
+}
 
-	return fmt.Errorf("all try connect is failed")
+type tryResult struct {
+	network int
+	conn    net.Conn
+	latency time.Duration
+	err     error
+}
 
+// tryAttempts lists the public ports advertised by the service and the address of the source itself
+func tryAttempts(s *source) []tryAttempt {
+	var attempts []tryAttempt
+	if s.service.PortTCP != 0 {
+		attempts = append(attempts, tryAttempt{
+			network: PublicNetworkTCP,
+			addr:    common.ParseSourceAddr("tcp", s.addr.IP, s.service.PortTCP),
+			try:     tryTCP,
+		})
+	}
+	//a nat blocking udp leaves only the tcp attempts
+	udp := s.support.NAT.NAT != stun.BehaviorBlocked
+	if s.service.PortUDP != 0 && udp {
+		attempts = append(attempts, tryAttempt{
+			network: PublicNetworkUDP,
+			addr:    common.ParseSourceAddr("udp", s.addr.IP, s.service.PortUDP),
+			try:     tryUDP,
+		})
+	}
+	addr := common.ParseSourceAddr(s.addr.Protocol, s.addr.IP, s.addr.Port)
+	switch s.addr.Network() {
+	case "tcp", "tcp4", "tcp6":
+		attempts = append(attempts, tryAttempt{
+			network: ProviderNetworkTCP,
+			addr:    addr,
+			try:     tryTCP,
+		})
+	case "udp", "udp4", "udp6":
+		if !udp {
+			break
+		}
+		attempts = append(attempts, tryAttempt{
+			network: ProviderNetworkUDP,
+			addr:    addr,
+			try:     tryUDP,
+		})
+	}
+	return attempts
 }
 
-// Connect ...
+// closeTryResults closes the connections of the attempts finished after the deadline
+func closeTryResults(results <-chan tryResult, pending int) {
+	for ; pending > 0; pending-- {
+		r := <-results
+		if r.conn != nil {
+			r.conn.Close()
+		}
+	}
+}
+
+// Connect announces the service to the source and tries the ways back to it, when none of them
+// connects the relay of the source is chosen, so Dial reaches the peers through the server
 func (s *source) Connect() error {
 	log.Infow("connect to", "ip", s.addr.String())
 
@@ -101,80 +291,62 @@ func (s *source) Connect() error {
 	if err != nil {
 		return err
 	}
-	return nil
-}
-
-func tryReverseNetworkConnect(s *source) error {
-	switch s.addr.Network() {
-	case "tcp", "tcp4", "tcp6":
-		tcpAddr := common.ParseSourceAddr(s.addr.Protocol, s.addr.IP, s.addr.Port)
-		if err := tryTCP(s, tcpAddr); err != nil {
-			return err
-		}
-		s.support.List[ProviderNetworkTCP] = true
-	case "udp", "udp4", "udp6":
-		udpAddr := common.ParseSourceAddr(s.addr.Protocol, s.addr.IP, s.addr.Port)
-		if err := tryUDP(s, udpAddr); err != nil {
-			return err
-		}
-		s.support.List[ProviderNetworkUDP] = true
-	default:
-		return fmt.Errorf("no reverse service found")
+	support, err := s.Try()
+	if support.Conn != nil {
+		support.Conn.Close()
+	}
+	if err != nil {
+		log.Infow("connect falls back to the relay", "error", err)
+		s.support.Chosen = StrategyRelay
 	}
 	return nil
 }
 
+// tryConnect runs the connect handshake on a new connection which is closed afterwards
 func tryConnect(s *source, addr *common.Addr) error {
+	start := time.Now()
 	switch s.addr.Network() {
 	case "tcp", "tcp4", "tcp6":
-		//tcpAddr := ParseSourceAddr(common.Protocol, common.IP, common.Port)
-		tcpAddr, err := reuse.DialTimeOut("tcp", common.LocalTCPAddr(s.mappingPortTCP).String(), addr.String(), s.timeout)
-		//tcpAddr, _, err := multiPortDialTCP(addr.TCP(), s.timeout, s.mappingPortTCP)
+		tcpAddr, err := s.dialTCP(s.mappingPortTCP)
 		if err != nil {
 			log.Debugw("debug|tryConnect|multiPortDialTCP", "error", err)
 			return err
 		}
-		data := make([]byte, maxByteSize)
-
-		if _, err := tcpConnect(s, tcpAddr, data); err != nil {
+		conn := s.secure(tcpAddr)
+		defer conn.Close()
+		if _, err := connect(s, conn); err != nil {
 			return err
 		}
-		s.support.List[ProviderNetworkTCP] = true
+		s.support.add(ProviderNetworkTCP, time.Since(start))
 	case "udp", "udp4", "udp6":
 		udp, err := multiPortDialUDP(addr.UDP(), s.mappingPortUDP)
 		if err != nil {
 			log.Debugw("debug|tryConnect|multiPortDialUDP", "error", err)
 			return err
 		}
-		data := make([]byte, maxByteSize)
-		if _, err := udpConnect(s, udp, data); err != nil {
+		defer udp.Close()
+		if _, err := connect(s, udp); err != nil {
 			return err
 		}
-		s.support.List[ProviderNetworkUDP] = true
+		s.support.add(ProviderNetworkUDP, time.Since(start))
+	case "kcp":
+		sess, err := dialKCP(addr.UDP())
+		if err != nil {
+			log.Debugw("debug|tryConnect|dialKCP", "error", err)
+			return err
+		}
+		//the session keeps its own goroutines until it is closed
+		defer sess.Close()
+		if _, err := connect(s, sess); err != nil {
+			return err
+		}
+		s.support.add(ProviderNetworkUDP, time.Since(start))
 	default:
 		return fmt.Errorf("no reverse service found")
 	}
 	return nil
 }
 
-func tryPublicNetworkConnect(s *source) error {
-	tcpAddr := common.ParseSourceAddr("tcp", s.addr.IP, s.service.PortTCP)
-	if err := tryTCP(s, tcpAddr); err != nil {
-		log.Debugw("debug|tryPublicNetworkConnect|tryTCP", "error", err)
-	} else {
-		s.support.List[PublicNetworkTCP] = true
-	}
-
-	udpAddr := common.ParseSourceAddr("udp", s.addr.IP, s.service.PortUDP)
-	if err := tryUDP(s, udpAddr); err != nil {
-		log.Debugw("debug|tryPublicNetworkConnect|tryUDP", "error", err)
-	} else {
-		s.support.List[PublicNetworkUDP] = true
-	}
-	log.Debugw("tryPublicNetworkConnect|finished")
-	return nil
-}
-
 func multiPortDialTCP(addr *net.TCPAddr, timeout time.Duration, lport int) (net.Conn, bool, error) {
 	tcp, err := reuse.DialTimeOut("tcp", common.LocalTCPAddr(lport).String(), addr.String(), timeout)
 	if err != nil {
@@ -200,196 +372,94 @@ func multiPortDialUDP(addr *net.UDPAddr, lport int) (*net.UDPConn, error) {
 	}
 	return udp, nil
 }
-func dialKCP(addr *net.UDPAddr) (net.Conn, error) {
-	udp, err := kcp.Dial(addr.String())
-	if err != nil {
-		return nil, err
-	}
-	return udp, nil
-}
-func tryUDP(s *source, addr *common.Addr) error {
+func tryUDP(s *source, addr *common.Addr) (net.Conn, error) {
 	udp, err := multiPortDialUDP(addr.UDP(), s.mappingPortUDP)
 	if err != nil {
 		log.Debugw("debug|tryUDP|DialUDP", "error", err)
-		return err
+		return nil, err
 	}
-	data := make([]byte, maxByteSize)
-	n, err := udpPing(s, udp, data)
-	if err != nil {
-		return err
+	if _, err := ping(s, udp); err != nil {
+		udp.Close()
+		return nil, err
 	}
-	//ignore n
-	_ = n
-	return nil
+	return udp, nil
 }
-func tcpConnect(s *source, conn net.Conn, data []byte) (n int, err error) {
-	if s.timeout != 0 {
-		err = conn.SetWriteDeadline(time.Now().Add(s.timeout))
-		if err != nil {
-			return 0, err
-		}
-	}
-	handshake := HandshakeHead{
-		Type: HandshakeTypeConnect,
-	}
-	_, err = conn.Write(handshake.Bytes())
+
+func handshake(s *source, conn net.Conn, ht HandshakeType, data []byte) (*HandshakeResponse, error) {
+	req, err := EncodeHandshake(HandshakeHead{
+		Type: ht,
+	}, data)
 	if err != nil {
-		log.Debugw("debug|tcpConnect|Write", "error", err)
-		return 0, err
+		return nil, err
 	}
-
 	if s.timeout != 0 {
 		err = conn.SetWriteDeadline(time.Now().Add(s.timeout))
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
 	}
-	req, err := EncodeHandshakeRequest(s.service)
-	if err != nil {
-		return 0, err
-	}
 	_, err = conn.Write(req)
 	if err != nil {
-		log.Debugw("debug|tcpConnect|Write", "error", err)
-		return 0, err
+		log.Debugw("debug|handshake|Write", "error", err)
+		return nil, err
 	}
 	if s.timeout != 0 {
 		err = conn.SetReadDeadline(time.Now().Add(s.timeout))
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
 	}
-	n, err = conn.Read(data)
+	resp, err := readHandshakeResponse(conn)
 	if err != nil {
-		log.Debugw("debug|tcpConnect|Read", "error", err)
-		return 0, err
-	}
-	log.Infow("tcp received", "data", string(data[:n]))
-	return n, nil
-}
-
-func tcpPing(s *source, conn net.Conn, data []byte) (n int, err error) {
-	if s.timeout != 0 {
-		err = conn.SetWriteDeadline(time.Now().Add(s.timeout))
-		if err != nil {
-			return 0, err
-		}
+		log.Debugw("debug|handshake|Read", "error", err)
+		return nil, err
 	}
-	handshake := HandshakeHead{
-		Type: HandshakeTypePing,
+	log.Infow("received", "network", conn.LocalAddr().Network(), "data", string(resp.Data))
+	if resp.Status != HandshakeStatusSuccess {
+		return nil, fmt.Errorf("handshake failed: %s", resp.Data)
 	}
+	return resp, nil
+}
 
-	_, err = conn.Write(handshake.Bytes())
-	if err != nil {
-		log.Debugw("debug|tcpPing|Write", "error", err)
-		return 0, err
-	}
-	if s.timeout != 0 {
-		err = conn.SetReadDeadline(time.Now().Add(s.timeout))
+// readHandshakeResponse reads a whole datagram on udp and one frame on stream connections
+func readHandshakeResponse(conn net.Conn) (*HandshakeResponse, error) {
+	if _, b := conn.(*net.UDPConn); b {
+		data := make([]byte, maxByteSize)
+		n, err := conn.Read(data)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
+		return DecodeHandshakeResponse(data[:n])
 	}
-	n, err = conn.Read(data)
-	if err != nil {
-		log.Debugw("debug|tcpPing|Read", "error", err)
-		return 0, err
-	}
-	log.Infow("tcp received", "data", string(data[:n]))
-	return n, nil
+	return ReadHandshakeResponse(conn)
 }
 
-func udpPing(s *source, conn net.Conn, data []byte) (n int, err error) {
-	if s.timeout != 0 {
-		err = conn.SetWriteDeadline(time.Now().Add(s.timeout))
-		if err != nil {
-			return 0, err
-		}
-	}
-	_, err = conn.Write(s.service.JSON())
-	if err != nil {
-		log.Debugw("debug|udpPing|Write", "error", err)
-		return 0, err
-	}
-	//data := make([]byte, maxByteSize)
-	if s.timeout != 0 {
-		err = conn.SetReadDeadline(time.Now().Add(s.timeout))
-		if err != nil {
-			return 0, err
-		}
-	}
-	n, err = conn.Read(data)
-	if err != nil {
-		log.Debugw("debug|udpPing|ReadFromUDP", "error", err)
-		return 0, err
-	}
-	log.Infow("udp received", "data", string(data[:n]))
-	return n, nil
+func ping(s *source, conn net.Conn) (*HandshakeResponse, error) {
+	return handshake(s, conn, HandshakeTypePing, nil)
 }
 
-func udpConnect(s *source, conn net.Conn, data []byte) (n int, err error) {
-	if s.timeout != 0 {
-		err = conn.SetWriteDeadline(time.Now().Add(s.timeout))
-		if err != nil {
-			return 0, err
-		}
-	}
-	handshake := HandshakeHead{
-		Type: HandshakeTypeConnect,
-	}
-	_, err = conn.Write(handshake.JSON())
-	if err != nil {
-		log.Debugw("debug|udpConnect|Write", "error", err)
-		return 0, err
-	}
-	if s.timeout != 0 {
-		err = conn.SetWriteDeadline(time.Now().Add(s.timeout))
-		if err != nil {
-			return 0, err
-		}
+func connect(s *source, conn net.Conn) (*HandshakeResponse, error) {
+	if err := s.authorize(conn); err != nil {
+		return nil, err
 	}
 	req, err := EncodeHandshakeRequest(s.service)
 	if err != nil {
-		return 0, err
-	}
-	_, err = conn.Write(req)
-	if err != nil {
-		log.Debugw("debug|udpConnect|Write", "error", err)
-		return 0, err
-	}
-	if s.timeout != 0 {
-		err = conn.SetReadDeadline(time.Now().Add(s.timeout))
-		if err != nil {
-			return 0, err
-		}
-	}
-	n, err = conn.Read(data)
-	if err != nil {
-		log.Debugw("debug|udpConnect|ReadFromUDP", "error", err)
-		return 0, err
+		return nil, err
 	}
-	log.Infow("udp received", "data", string(data[:n]))
-	return n, nil
+	return handshake(s, conn, HandshakeTypeConnect, req)
 }
 
-func tryTCP(s *source, addr *common.Addr) error {
+func tryTCP(s *source, addr *common.Addr) (net.Conn, error) {
 	log.Debugw("connect tcp", "port", s.mappingPortTCP, "common", addr.TCP().String())
-	tcp, keep, err := multiPortDialTCP(addr.TCP(), 5*time.Second, s.mappingPortTCP)
+	tcp, _, err := multiPortDialTCP(addr.TCP(), s.timeout, s.mappingPortTCP)
 	if err != nil {
 		log.Debugw("debug|tryTCP|DialTCP", "error", err)
-		return err
-	}
-	if !keep {
-		defer tcp.Close()
+		return nil, err
 	}
-	s.service.ID = GlobalID
-	s.service.KeepConnect = true
-	data := make([]byte, maxByteSize)
-	n, err := tcpPing(s, tcp, data)
-	if err != nil {
-		return err
+	tcp = s.secure(tcp)
+	if _, err := ping(s, tcp); err != nil {
+		tcp.Close()
+		return nil, err
 	}
-	//ignore n
-	_ = n
-	return nil
+	return tcp, nil
 }
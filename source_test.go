@@ -1,9 +1,12 @@
 package lurker
 
 import (
-	"github.com/portmapping/lurker/common"
+	"context"
 	"net"
 	"testing"
+
+	"github.com/portmapping/lurker/common"
+	"github.com/portmapping/lurker/stun"
 )
 
 // TestSource_Connect ...
@@ -28,3 +31,60 @@ func TestSource_Connect(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// TestSource_Try ...
+func TestSource_Try(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.NAT = false
+	cfg.TCP = freeTCPPort(t)
+	cfg.UDP = freeUDPPort(t)
+	l := New(cfg)
+	l.RegisterListener("tcp", NewTCPListener(cfg))
+	l.RegisterListener("udp", NewUDPListener(cfg))
+	c, err := l.Listen(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range c {
+		}
+	}()
+
+	s := NewSource(Service{ID: "try", PortUDP: cfg.UDP}, *common.ParseSourceAddr("tcp", net.IPv4(127, 0, 0, 1), cfg.TCP))
+	support, err := s.Try()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer support.Conn.Close()
+	if support.Network != PublicNetworkUDP && support.Network != ProviderNetworkTCP {
+		t.Fatal("wrong network", support.Network)
+	}
+	if !support.List[support.Network] || support.Type&(SupportType(1)<<uint(support.Network)) == 0 {
+		t.Fatal("winner was not recorded", support)
+	}
+	if support.Latency[support.Network] <= 0 {
+		t.Fatal("latency was not recorded", support)
+	}
+	//the attempt which lost is recorded as well
+	if !support.List[PublicNetworkUDP] || !support.List[ProviderNetworkTCP] || support.Latency[PublicNetworkUDP] <= 0 {
+		t.Fatal("every attempt was not recorded", support)
+	}
+	if support.Chosen != StrategyDirect && support.Chosen != StrategyReverse {
+		t.Fatal("wrong strategy", support.Chosen)
+	}
+
+	closed := freeTCPPort(t)
+	s = NewSource(Service{ID: "try"}, *common.ParseSourceAddr("tcp", net.IPv4(127, 0, 0, 1), closed))
+	//a known nat is not detected again
+	s.(*source).support.NAT.NAT = stun.BehaviorBlocked
+	support, err = s.Try()
+	if err == nil || support.Conn != nil || support.Network != NetworkSupportMax {
+		t.Fatal("closed port was connected", support)
+	}
+	if support.Errors[ProviderNetworkTCP] == nil {
+		t.Fatal("failure was not recorded", support)
+	}
+	if support.Chosen != StrategyRelay {
+		t.Fatal("wrong strategy", support.Chosen)
+	}
+}
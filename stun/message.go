@@ -0,0 +1,236 @@
+package stun
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+const headerSize = 20
+
+// MagicCookie ...
+const MagicCookie uint32 = 0x2112A442
+
+// MessageType ...
+type MessageType uint16
+
+// MessageType ...
+const (
+	TypeBindingRequest  MessageType = 0x0001
+	TypeBindingResponse MessageType = 0x0101
+	TypeBindingError    MessageType = 0x0111
+)
+
+// AttributeType ...
+type AttributeType uint16
+
+// AttributeType ...
+const (
+	AttrMappedAddress    AttributeType = 0x0001
+	AttrChangeRequest    AttributeType = 0x0003
+	AttrChangedAddress   AttributeType = 0x0005
+	AttrErrorCode        AttributeType = 0x0009
+	AttrXORMappedAddress AttributeType = 0x0020
+	AttrSoftware         AttributeType = 0x8022
+	AttrResponseOrigin   AttributeType = 0x802b
+	AttrOtherAddress     AttributeType = 0x802c
+)
+
+const (
+	changeIP   = 0x04
+	changePort = 0x02
+)
+
+var errWrongMessage = errors.New("wrong stun message")
+var errNoAddress = errors.New("address attribute was not found")
+
+// Attribute ...
+type Attribute struct {
+	Type  AttributeType
+	Value []byte
+}
+
+// Message ...
+type Message struct {
+	Type          MessageType
+	TransactionID [12]byte
+	Attributes    []Attribute
+}
+
+// NewMessage returns a message with a random transaction id
+func NewMessage(t MessageType) *Message {
+	m := &Message{
+		Type: t,
+	}
+	_, _ = rand.Read(m.TransactionID[:])
+	return m
+}
+
+// IsMessage reports whether the datagram looks like a stun message
+func IsMessage(data []byte) bool {
+	return len(data) >= headerSize &&
+		data[0]&0xc0 == 0 &&
+		binary.BigEndian.Uint32(data[4:8]) == MagicCookie
+}
+
+// ParseMessage ...
+func ParseMessage(data []byte) (*Message, error) {
+	if !IsMessage(data) {
+		return nil, errWrongMessage
+	}
+	size := int(binary.BigEndian.Uint16(data[2:4]))
+	if len(data) < headerSize+size {
+		return nil, errWrongMessage
+	}
+	m := &Message{
+		Type: MessageType(binary.BigEndian.Uint16(data[0:2])),
+	}
+	copy(m.TransactionID[:], data[8:20])
+	body := data[headerSize : headerSize+size]
+	for len(body) >= 4 {
+		t := AttributeType(binary.BigEndian.Uint16(body[0:2]))
+		l := int(binary.BigEndian.Uint16(body[2:4]))
+		if len(body) < 4+l {
+			return nil, errWrongMessage
+		}
+		m.Attributes = append(m.Attributes, Attribute{
+			Type:  t,
+			Value: body[4 : 4+l],
+		})
+		//attributes are padded to 4 bytes
+		next := 4 + (l+3)&^3
+		if next > len(body) {
+			break
+		}
+		body = body[next:]
+	}
+	return m, nil
+}
+
+// Bytes ...
+func (m *Message) Bytes() []byte {
+	size := 0
+	for _, a := range m.Attributes {
+		size += 4 + (len(a.Value)+3)&^3
+	}
+	data := make([]byte, headerSize+size)
+	binary.BigEndian.PutUint16(data[0:2], uint16(m.Type))
+	binary.BigEndian.PutUint16(data[2:4], uint16(size))
+	binary.BigEndian.PutUint32(data[4:8], MagicCookie)
+	copy(data[8:20], m.TransactionID[:])
+	off := headerSize
+	for _, a := range m.Attributes {
+		binary.BigEndian.PutUint16(data[off:], uint16(a.Type))
+		binary.BigEndian.PutUint16(data[off+2:], uint16(len(a.Value)))
+		copy(data[off+4:], a.Value)
+		off += 4 + (len(a.Value)+3)&^3
+	}
+	return data
+}
+
+// Add ...
+func (m *Message) Add(t AttributeType, v []byte) {
+	m.Attributes = append(m.Attributes, Attribute{
+		Type:  t,
+		Value: v,
+	})
+}
+
+// Get ...
+func (m *Message) Get(t AttributeType) ([]byte, bool) {
+	for _, a := range m.Attributes {
+		if a.Type == t {
+			return a.Value, true
+		}
+	}
+	return nil, false
+}
+
+// AddAddr adds an address attribute, xor-ed when the type is XOR-MAPPED-ADDRESS
+func (m *Message) AddAddr(t AttributeType, addr *net.UDPAddr) {
+	ip := addr.IP.To4()
+	family := byte(0x01)
+	if ip == nil {
+		ip = addr.IP.To16()
+		family = 0x02
+	}
+	v := make([]byte, 4+len(ip))
+	v[1] = family
+	binary.BigEndian.PutUint16(v[2:4], uint16(addr.Port))
+	copy(v[4:], ip)
+	if t == AttrXORMappedAddress {
+		m.xor(v)
+	}
+	m.Add(t, v)
+}
+
+// Addr returns the address attribute of type t
+func (m *Message) Addr(t AttributeType) (*net.UDPAddr, error) {
+	v, b := m.Get(t)
+	if !b {
+		return nil, errNoAddress
+	}
+	if len(v) != 8 && len(v) != 20 {
+		return nil, errWrongMessage
+	}
+	c := make([]byte, len(v))
+	copy(c, v)
+	if t == AttrXORMappedAddress {
+		m.xor(c)
+	}
+	return &net.UDPAddr{
+		IP:   net.IP(c[4:]),
+		Port: int(binary.BigEndian.Uint16(c[2:4])),
+	}, nil
+}
+
+// MappedAddr prefers XOR-MAPPED-ADDRESS and falls back to MAPPED-ADDRESS of rfc3489 servers
+func (m *Message) MappedAddr() (*net.UDPAddr, error) {
+	addr, err := m.Addr(AttrXORMappedAddress)
+	if err == nil {
+		return addr, nil
+	}
+	return m.Addr(AttrMappedAddress)
+}
+
+// OtherAddr returns the alternate address of the server
+func (m *Message) OtherAddr() (*net.UDPAddr, error) {
+	addr, err := m.Addr(AttrOtherAddress)
+	if err == nil {
+		return addr, nil
+	}
+	return m.Addr(AttrChangedAddress)
+}
+
+// ChangeRequest returns the CHANGE-REQUEST flags of the message
+func (m *Message) ChangeRequest() (ip bool, port bool) {
+	v, b := m.Get(AttrChangeRequest)
+	if !b || len(v) != 4 {
+		return false, false
+	}
+	return v[3]&changeIP != 0, v[3]&changePort != 0
+}
+
+// SetChangeRequest ...
+func (m *Message) SetChangeRequest(ip bool, port bool) {
+	v := make([]byte, 4)
+	if ip {
+		v[3] |= changeIP
+	}
+	if port {
+		v[3] |= changePort
+	}
+	m.Add(AttrChangeRequest, v)
+}
+
+func (m *Message) xor(v []byte) {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint32(key, MagicCookie)
+	copy(key[4:], m.TransactionID[:])
+	v[2] ^= key[0]
+	v[3] ^= key[1]
+	for i := 4; i < len(v); i++ {
+		v[i] ^= key[i-4]
+	}
+}
@@ -0,0 +1,135 @@
+package stun
+
+import (
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/portmapping/go-reuse"
+)
+
+// Software ...
+var Software = "lurker"
+
+// Server answers the binding requests of rfc5389, the CHANGE-REQUEST of rfc5780 is honoured
+// when an alternate ip and port are available
+type Server struct {
+	//conns is indexed by [ip][port], the primary socket is [0][0]
+	conns [2][2]net.PacketConn
+	other *net.UDPAddr
+}
+
+var errNoPrimary = errors.New("primary socket is not udp")
+
+// NewServer serves the binding requests received on primary, the caller keeps reading primary
+// and passes the stun messages to Handle. When altIP and altPort are given, sockets are bound
+// on both ports of both ips and served here, primary must have been bound with SO_REUSEADDR then
+func NewServer(primary net.PacketConn, altIP net.IP, altPort int) (*Server, error) {
+	local, b := primary.LocalAddr().(*net.UDPAddr)
+	if !b {
+		return nil, errNoPrimary
+	}
+	s := &Server{}
+	s.conns[0][0] = primary
+	if altIP == nil || altPort == 0 {
+		return s, nil
+	}
+	binds := []struct {
+		i, j int
+		ip   net.IP
+		port int
+	}{
+		{0, 1, local.IP, altPort},
+		{1, 0, altIP, local.Port},
+		{1, 1, altIP, altPort},
+	}
+	for _, bind := range binds {
+		conn, err := reuse.ListenPacket("udp", net.JoinHostPort(bind.ip.String(), strconv.Itoa(bind.port)))
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.conns[bind.i][bind.j] = conn
+	}
+	s.other = &net.UDPAddr{
+		IP:   altIP,
+		Port: altPort,
+	}
+	for _, bind := range binds {
+		go s.serve(bind.i, bind.j)
+	}
+	return s, nil
+}
+
+// Handle answers the message received on the primary socket,
+// false is returned when the data is not a stun message
+func (s *Server) Handle(data []byte, from net.Addr) bool {
+	if !IsMessage(data) {
+		return false
+	}
+	s.handle(0, 0, data, from)
+	return true
+}
+
+// Close closes the alternate sockets, the primary one is left to its owner
+func (s *Server) Close() error {
+	for i := range s.conns {
+		for j := range s.conns[i] {
+			if (i != 0 || j != 0) && s.conns[i][j] != nil {
+				s.conns[i][j].Close()
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) serve(i, j int) {
+	data := make([]byte, 1500)
+	for {
+		n, from, err := s.conns[i][j].ReadFrom(data)
+		if err != nil {
+			return
+		}
+		if IsMessage(data[:n]) {
+			s.handle(i, j, data[:n], from)
+		}
+	}
+}
+
+func (s *Server) handle(i, j int, data []byte, from net.Addr) {
+	req, err := ParseMessage(data)
+	if err != nil || req.Type != TypeBindingRequest {
+		return
+	}
+	addr, b := from.(*net.UDPAddr)
+	if !b {
+		return
+	}
+	ci, cp := req.ChangeRequest()
+	if (ci || cp) && s.other == nil {
+		//a server without alternate address can not honour the change, the client takes it as filtered
+		return
+	}
+	if ci {
+		i = 1 - i
+	}
+	if cp {
+		j = 1 - j
+	}
+	conn := s.conns[i][j]
+	resp := &Message{
+		Type:          TypeBindingResponse,
+		TransactionID: req.TransactionID,
+	}
+	resp.AddAddr(AttrXORMappedAddress, addr)
+	resp.AddAddr(AttrMappedAddress, addr)
+	if origin, b := conn.LocalAddr().(*net.UDPAddr); b && !origin.IP.IsUnspecified() {
+		resp.AddAddr(AttrResponseOrigin, origin)
+	}
+	if s.other != nil {
+		resp.AddAddr(AttrOtherAddress, s.other)
+		resp.AddAddr(AttrChangedAddress, s.other)
+	}
+	resp.Add(AttrSoftware, []byte(Software))
+	_, _ = conn.WriteTo(resp.Bytes(), from)
+}
@@ -1,13 +1,272 @@
 package stun
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
-	"github.com/ccding/go-stun/stun"
+	"net"
+	"time"
 )
 
-// Support ...
-func Support() {
-	cli := stun.NewClient()
-	nat, host, err := cli.Discover()
-	fmt.Println(nat, host, err)
+// Behavior is the mapping and filtering behavior of the nat in front of a socket
+type Behavior int
+
+// Behavior ...
+const (
+	BehaviorUnknown Behavior = iota
+	BehaviorBlocked
+	BehaviorOpen
+	BehaviorFirewall
+	BehaviorFullCone
+	BehaviorRestricted
+	BehaviorPortRestricted
+	BehaviorSymmetric
+)
+
+var behaviorStr = map[Behavior]string{
+	BehaviorUnknown:        "unknown",
+	BehaviorBlocked:        "udp blocked",
+	BehaviorOpen:           "open internet",
+	BehaviorFirewall:       "symmetric udp firewall",
+	BehaviorFullCone:       "full cone",
+	BehaviorRestricted:     "restricted cone",
+	BehaviorPortRestricted: "port restricted cone",
+	BehaviorSymmetric:      "symmetric",
+}
+
+// String ...
+func (b Behavior) String() string {
+	if s, ok := behaviorStr[b]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// DefaultServers are public servers answering the CHANGE-REQUEST of rfc3489/rfc5780
+var DefaultServers = []string{
+	"stun.stunprotocol.org:3478",
+	"stun.ekiga.net:3478",
+}
+
+// DefaultTimeout is the time waited for each answer, an unanswered test takes this long
+var DefaultTimeout = 3 * time.Second
+
+// DefaultRetransmit ...
+var DefaultRetransmit = 500 * time.Millisecond
+
+var errNoServer = errors.New("no stun server was answered")
+
+// Result ...
+type Result struct {
+	NAT     Behavior     `json:"nat"`
+	Mapped  *net.UDPAddr `json:"mapped"`
+	Hairpin bool         `json:"hairpin"`
+	Server  string       `json:"server"`
+}
+
+// String ...
+func (r Result) String() string {
+	return fmt.Sprintf("nat: %v, mapped: %v, hairpin: %v, server: %v", r.NAT, r.Mapped, r.Hairpin, r.Server)
+}
+
+// Client ...
+type Client struct {
+	Servers    []string
+	Timeout    time.Duration
+	Retransmit time.Duration
+}
+
+// NewClient returns a client of the servers, or of DefaultServers when none is given
+func NewClient(servers ...string) *Client {
+	if len(servers) == 0 {
+		servers = DefaultServers
+	}
+	return &Client{
+		Servers:    servers,
+		Timeout:    DefaultTimeout,
+		Retransmit: DefaultRetransmit,
+	}
+}
+
+// Discover classifies the nat with a new socket on a random port
+func Discover(servers ...string) (*Result, error) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return NewClient(servers...).Discover(conn)
+}
+
+// Discover classifies the nat in front of conn against the servers in order,
+// the first server giving a full classification wins
+func (c *Client) Discover(conn net.PacketConn) (*Result, error) {
+	defer conn.SetReadDeadline(time.Time{})
+	var last *Result
+	for _, server := range c.Servers {
+		addr, err := net.ResolveUDPAddr("udp", server)
+		if err != nil {
+			continue
+		}
+		r, err := c.discover(conn, addr)
+		if err != nil {
+			continue
+		}
+		r.Server = server
+		if r.NAT != BehaviorUnknown && r.NAT != BehaviorBlocked {
+			return r, nil
+		}
+		if last == nil || last.NAT == BehaviorBlocked {
+			last = r
+		}
+	}
+	if last == nil {
+		return nil, errNoServer
+	}
+	return last, nil
+}
+
+// discover follows the flow of rfc3489 section 10.1
+func (c *Client) discover(conn net.PacketConn, server *net.UDPAddr) (*Result, error) {
+	resp, err := c.binding(conn, server, false, false)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return &Result{NAT: BehaviorBlocked}, nil
+	}
+	mapped, err := resp.MappedAddr()
+	if err != nil {
+		return nil, err
+	}
+	r := &Result{
+		NAT:    BehaviorUnknown,
+		Mapped: mapped,
+	}
+	other, err := resp.OtherAddr()
+	if err != nil {
+		//the server has no alternate address, only the mapped address is known
+		return r, nil
+	}
+
+	resp, err = c.binding(conn, server, true, true)
+	if err != nil {
+		return nil, err
+	}
+	if isLocal(conn.LocalAddr(), mapped) {
+		r.NAT = BehaviorFirewall
+		if resp != nil {
+			r.NAT = BehaviorOpen
+		}
+		return r, nil
+	}
+	r.Hairpin = c.hairpin(conn, mapped)
+	if resp != nil {
+		r.NAT = BehaviorFullCone
+		return r, nil
+	}
+
+	resp, err = c.binding(conn, other, false, false)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return r, nil
+	}
+	mapped2, err := resp.MappedAddr()
+	if err != nil {
+		return nil, err
+	}
+	if !mapped2.IP.Equal(mapped.IP) || mapped2.Port != mapped.Port {
+		r.NAT = BehaviorSymmetric
+		return r, nil
+	}
+
+	resp, err = c.binding(conn, server, false, true)
+	if err != nil {
+		return nil, err
+	}
+	r.NAT = BehaviorPortRestricted
+	if resp != nil {
+		r.NAT = BehaviorRestricted
+	}
+	return r, nil
+}
+
+// hairpin sends a request to the own mapped address and waits for it to come back
+func (c *Client) hairpin(conn net.PacketConn, mapped *net.UDPAddr) bool {
+	req := NewMessage(TypeBindingRequest)
+	m, err := c.roundTrip(conn, mapped, req)
+	return err == nil && m != nil
+}
+
+// binding sends a binding request, a nil message is returned when nothing was answered
+func (c *Client) binding(conn net.PacketConn, addr *net.UDPAddr, ip bool, port bool) (*Message, error) {
+	req := NewMessage(TypeBindingRequest)
+	if ip || port {
+		req.SetChangeRequest(ip, port)
+	}
+	resp, err := c.roundTrip(conn, addr, req)
+	if err != nil || resp == nil {
+		return nil, err
+	}
+	if resp.Type != TypeBindingResponse {
+		return nil, fmt.Errorf("binding was failed with type: %x", resp.Type)
+	}
+	return resp, nil
+}
+
+// roundTrip retransmits the request until a message of the same transaction arrives or time is out
+func (c *Client) roundTrip(conn net.PacketConn, addr net.Addr, req *Message) (*Message, error) {
+	data := req.Bytes()
+	buf := make([]byte, 1500)
+	deadline := time.Now().Add(c.Timeout)
+	for time.Now().Before(deadline) {
+		if _, err := conn.WriteTo(data, addr); err != nil {
+			return nil, err
+		}
+		wait := time.Now().Add(c.Retransmit)
+		if wait.After(deadline) {
+			wait = deadline
+		}
+		if err := conn.SetReadDeadline(wait); err != nil {
+			return nil, err
+		}
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				if e, b := err.(net.Error); b && e.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			m, err := ParseMessage(buf[:n])
+			if err != nil || !bytes.Equal(m.TransactionID[:], req.TransactionID[:]) {
+				continue
+			}
+			return m, nil
+		}
+	}
+	return nil, nil
+}
+
+// isLocal reports whether the mapped address is the address of the socket itself
+func isLocal(local net.Addr, mapped *net.UDPAddr) bool {
+	addr, b := local.(*net.UDPAddr)
+	if !b || addr.Port != mapped.Port {
+		return false
+	}
+	if !addr.IP.IsUnspecified() {
+		return addr.IP.Equal(mapped.IP)
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipNet, b := a.(*net.IPNet); b && ipNet.IP.Equal(mapped.IP) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,146 @@
+package stun
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// responder is an in-process server on 127.0.0.1 and 127.0.0.2 which pretends to be
+// behind the nat described by mapped and the change requests it answers
+type responder struct {
+	conns      [2][2]*net.UDPConn
+	mapped     func(ip int, port int, from *net.UDPAddr) *net.UDPAddr
+	changeIP   bool
+	changePort bool
+}
+
+func newResponder(t *testing.T, mapped func(int, int, *net.UDPAddr) *net.UDPAddr, changeIP bool, changePort bool) *responder {
+	r := &responder{
+		mapped:     mapped,
+		changeIP:   changeIP,
+		changePort: changePort,
+	}
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)}
+	for {
+		p1, err := net.ListenUDP("udp", &net.UDPAddr{IP: ips[0]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p2, err := net.ListenUDP("udp", &net.UDPAddr{IP: ips[0]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.conns[0] = [2]*net.UDPConn{p1, p2}
+		a1, err1 := net.ListenUDP("udp", &net.UDPAddr{IP: ips[1], Port: p1.LocalAddr().(*net.UDPAddr).Port})
+		a2, err2 := net.ListenUDP("udp", &net.UDPAddr{IP: ips[1], Port: p2.LocalAddr().(*net.UDPAddr).Port})
+		if err1 == nil && err2 == nil {
+			r.conns[1] = [2]*net.UDPConn{a1, a2}
+			break
+		}
+		for _, c := range []*net.UDPConn{p1, p2, a1, a2} {
+			if c != nil {
+				c.Close()
+			}
+		}
+	}
+	for i := range r.conns {
+		for j := range r.conns[i] {
+			go r.serve(i, j)
+		}
+	}
+	return r
+}
+
+func (r *responder) addr() string {
+	return r.conns[0][0].LocalAddr().String()
+}
+
+func (r *responder) close() {
+	for i := range r.conns {
+		for j := range r.conns[i] {
+			r.conns[i][j].Close()
+		}
+	}
+}
+
+func (r *responder) serve(i, j int) {
+	data := make([]byte, 1500)
+	for {
+		n, from, err := r.conns[i][j].ReadFromUDP(data)
+		if err != nil {
+			return
+		}
+		req, err := ParseMessage(data[:n])
+		if err != nil || req.Type != TypeBindingRequest {
+			continue
+		}
+		ci, cp := req.ChangeRequest()
+		if ci && !r.changeIP || cp && !r.changePort {
+			continue
+		}
+		oi, oj := i, j
+		if ci {
+			oi = 1 - i
+		}
+		if cp {
+			oj = 1 - j
+		}
+		resp := &Message{
+			Type:          TypeBindingResponse,
+			TransactionID: req.TransactionID,
+		}
+		resp.AddAddr(AttrXORMappedAddress, r.mapped(i, j, from))
+		resp.AddAddr(AttrOtherAddress, r.conns[1-i][1-j].LocalAddr().(*net.UDPAddr))
+		_, _ = r.conns[oi][oj].WriteToUDP(resp.Bytes(), from)
+	}
+}
+
+func natMapped(ip net.IP) func(int, int, *net.UDPAddr) *net.UDPAddr {
+	return func(_ int, _ int, from *net.UDPAddr) *net.UDPAddr {
+		return &net.UDPAddr{IP: ip, Port: from.Port}
+	}
+}
+
+// TestClient_Discover ...
+func TestClient_Discover(t *testing.T) {
+	symmetric := func(i int, j int, from *net.UDPAddr) *net.UDPAddr {
+		return &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: from.Port + 2*i + j}
+	}
+	tests := []struct {
+		name       string
+		mapped     func(int, int, *net.UDPAddr) *net.UDPAddr
+		changeIP   bool
+		changePort bool
+		want       Behavior
+		hairpin    bool
+	}{
+		{"open", natMapped(net.IPv4(127, 0, 0, 1)), true, true, BehaviorOpen, false},
+		{"firewall", natMapped(net.IPv4(127, 0, 0, 1)), false, false, BehaviorFirewall, false},
+		{"full cone", natMapped(net.IPv4(127, 0, 0, 3)), true, true, BehaviorFullCone, true},
+		{"restricted", natMapped(net.IPv4(192, 0, 2, 1)), false, true, BehaviorRestricted, false},
+		{"port restricted", natMapped(net.IPv4(192, 0, 2, 1)), false, false, BehaviorPortRestricted, false},
+		{"symmetric", symmetric, false, false, BehaviorSymmetric, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newResponder(t, tt.mapped, tt.changeIP, tt.changePort)
+			defer r.close()
+
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			c := NewClient("127.0.0.1:1", r.addr())
+			c.Timeout, c.Retransmit = 300*time.Millisecond, 100*time.Millisecond
+			result, err := c.Discover(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.NAT != tt.want || result.Hairpin != tt.hairpin || result.Server != r.addr() {
+				t.Fatal("wrong result", result)
+			}
+		})
+	}
+}
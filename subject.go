@@ -1,27 +1,115 @@
 package lurker
 
 import (
+	"encoding/json"
 	"sync"
 )
 
 // Subject ...
 type Subject interface {
 	Add(connector Connector) error
+	Get(id string) (Peer, bool)
 }
 
 type subject struct {
+	lock       sync.Mutex
 	connectors sync.Map
+	sessions   sync.Map
+}
+
+type subjectPeer struct {
+	peer      Peer
+	connector Connector
 }
 
 // Add ...
 func (s *subject) Add(connector Connector) error {
-	connector.ConnectorListener().ID(func(id string) {
-		s.connectors.Store(id, connector)
+	connector.ConnectorListener().RegisterCallback(func(rt HandshakeType, data []byte) {
+		switch rt {
+		case HandshakeTypeConnect:
+			p, err := ParsePeer(data)
+			if err != nil {
+				log.Debugw("debug|subject|ParsePeer", "error", err)
+				return
+			}
+			//only the kept connectors wait for the rendezvous, the others are closed after the reply
+			if !p.Service.KeepConnect {
+				return
+			}
+			s.store(p, connector)
+		case HandshakeTypeAdapter:
+			s.rendezvous(connector, data)
+		case HandshakeTypeRelay:
+			s.relay(connector, data)
+		}
 	})
-
 	return nil
 }
 
+// store registers the connector of the peer, it is removed when the connector is closed
+func (s *subject) store(p Peer, connector Connector) {
+	s.lock.Lock()
+	s.connectors.Store(p.ID, &subjectPeer{
+		peer:      p,
+		connector: connector,
+	})
+	s.lock.Unlock()
+	connector.ConnectorListener().Closed(func() {
+		s.remove(p.ID, connector)
+	})
+}
+
+// remove deletes the peer only when it was not replaced by a newer connector
+func (s *subject) remove(id string, connector Connector) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	v, b := s.connectors.Load(id)
+	if b && v.(*subjectPeer).connector == connector {
+		s.connectors.Delete(id)
+	}
+}
+
+// Get ...
+func (s *subject) Get(id string) (Peer, bool) {
+	v, b := s.connectors.Load(id)
+	if !b {
+		return Peer{}, false
+	}
+	return v.(*subjectPeer).peer, true
+}
+
+// rendezvous sends each side the address of the other one
+func (s *subject) rendezvous(connector Connector, data []byte) {
+	var r RendezvousRequest
+	err := json.Unmarshal(data, &r)
+	if err != nil {
+		log.Debugw("debug|rendezvous|Unmarshal", "error", err)
+		return
+	}
+	v, b := s.connectors.Load(r.Target)
+	if !b {
+		s.reply(connector, HandshakeStatusFailed, []byte("peer was not found"))
+		return
+	}
+	target := v.(*subjectPeer)
+	err = target.connector.Reply(HandshakeStatusSuccess, r.Peer.JSON())
+	if err != nil {
+		log.Debugw("debug|rendezvous|Reply", "id", r.Target, "error", err)
+		s.remove(r.Target, target.connector)
+		s.reply(connector, HandshakeStatusFailed, []byte("peer was offline"))
+		return
+	}
+	log.Infow("rendezvous", "from", r.Peer.ID, "to", r.Target)
+	s.reply(connector, HandshakeStatusSuccess, target.peer.JSON())
+}
+
+func (s *subject) reply(connector Connector, status HandshakeStatus, data []byte) {
+	err := connector.Reply(status, data)
+	if err != nil {
+		log.Debugw("debug|subject|Reply", "error", err)
+	}
+}
+
 // NewSubject ...
 func NewSubject() Subject {
 	return &subject{}
@@ -1,7 +1,9 @@
 package lurker
 
 import (
+	"encoding/json"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/portmapping/lurker/common"
@@ -10,11 +12,19 @@ import (
 var _ Connector = &tcpConnector{}
 
 type tcpConnector struct {
-	id      func(id string)
-	addr    func(addr common.Addr)
+	connectorListener
 	timeout time.Duration
 	conn    net.Conn
 	ticker  *time.Ticker
+	lock    sync.RWMutex
+	head    HandshakeHead
+	payload []byte
+	keep    bool
+	//hijacked connections are owned by the relay
+	hijacked bool
+	stopping bool
+	closed   func()
+	auth     *authorizer
 }
 
 // ConnectorListener ...
@@ -22,19 +32,36 @@ func (c *tcpConnector) ConnectorListener() ConnectorListener {
 	return c
 }
 
-// Addr ...
-func (c *tcpConnector) Addr(f func(addr common.Addr)) {
-	c.addr = f
-}
-
 // Header ...
 func (c *tcpConnector) Header() (HandshakeHead, error) {
-	b := make([]byte, 8)
-	_, err := c.conn.Read(b)
+	deadline := time.Time{}
+	if !c.keep {
+		deadline = time.Now().Add(DefaultTimeout)
+	}
+	c.lock.Lock()
+	if c.stopping {
+		c.lock.Unlock()
+		return HandshakeHead{}, errConnectorClosed
+	}
+	err := c.conn.SetReadDeadline(deadline)
+	c.lock.Unlock()
 	if err != nil {
 		return HandshakeHead{}, err
 	}
-	return ParseHandshakeByte(b)
+	h, payload, err := ReadHandshake(c.conn)
+	if err != nil {
+		c.lock.RLock()
+		stopping := c.stopping
+		c.lock.RUnlock()
+		if stopping {
+			return HandshakeHead{}, errConnectorClosed
+		}
+		return HandshakeHead{}, err
+	}
+	c.lock.Lock()
+	c.head, c.payload = h, payload
+	c.lock.Unlock()
+	return h, nil
 }
 
 // Reply ...
@@ -44,31 +71,28 @@ func (c *tcpConnector) Reply(status HandshakeStatus, data []byte) error {
 		Data:   data,
 	}
 
+	c.lock.RLock()
+	ver := c.head.Version
+	c.lock.RUnlock()
+	resp, err := EncodeHandshakeResponse(ver, &r)
+	if err != nil {
+		return err
+	}
 	if c.timeout != 0 {
-		err := c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+		err := c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
 		if err != nil {
-			log.Debugw("debug|Reply|SetReadDeadline", "error", err)
+			log.Debugw("debug|Reply|SetWriteDeadline", "error", err)
 			return err
 		}
 	}
-	_, err := c.conn.Write(r.JSON())
+	_, err = c.conn.Write(resp)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// RegisterCallback ...
-func (c *tcpConnector) RegisterCallback(cb ConnectorCallback) {
-
-}
-
-// ID ...
-func (c *tcpConnector) ID(f func(string)) {
-	c.id = f
-}
-
-func newTCPConnector(conn net.Conn) Connector {
+func newTCPConnector(conn net.Conn) *tcpConnector {
 	c := &tcpConnector{
 		timeout: 5 * time.Second,
 		conn:    conn,
@@ -79,59 +103,156 @@ func newTCPConnector(conn net.Conn) Connector {
 
 func (c *tcpConnector) interaction() (err error) {
 	log.Debugw("interaction call")
-	data := make([]byte, maxByteSize)
-	if c.timeout != 0 {
-		err := c.conn.SetReadDeadline(time.Now().Add(c.timeout))
-		if err != nil {
-			log.Debugw("debug|Reply|SetReadDeadline", "error", err)
-			return err
-		}
-	}
-	log.Info("read data")
-	n, err := c.conn.Read(data)
+	data, err := c.request()
 	if err != nil {
 		log.Debugw("debug|Reply|Read", "error", err)
 		return err
 	}
 
 	var r HandshakeRequest
-	service, err := DecodeHandshakeRequest(data[:n], &r)
+	service, err := DecodeHandshakeRequest(data, &r)
 	if err != nil {
 		log.Debugw("debug|Reply|DecodeHandshakeRequest", "error", err)
 		return err
 	}
 
-	if c.id != nil {
-		c.id(service.ID)
+	if err := c.identify(service.ID); err != nil {
+		_ = c.Reply(HandshakeStatusFailed, []byte(err.Error()))
+		return err
 	}
+	c.callID(service.ID)
 	netAddr := common.ParseNetAddr(c.conn.RemoteAddr())
 	log.Debugw("debug|Reply|ParseNetAddr", "common", netAddr)
-	if c.addr != nil {
-		c.addr(*netAddr)
+	c.callAddr(*netAddr)
+	c.keep = service.KeepConnect
+	c.callback(HandshakeTypeConnect, Peer{
+		ID:      service.ID,
+		Addr:    *netAddr,
+		Service: service,
+	}.JSON())
+	log.Info("write data")
+	return c.Reply(HandshakeStatusSuccess, []byte("Connected"))
+}
+
+// request returns the payload of the current handshake,
+// Version1 peers send it unframed after the head
+func (c *tcpConnector) request() ([]byte, error) {
+	if c.head.Version.IsFramed() {
+		return c.payload, nil
 	}
-	var resp HandshakeResponse
-	resp.Status = HandshakeStatusSuccess
-	resp.Data = []byte("Connected")
+	data := make([]byte, maxByteSize)
 	if c.timeout != 0 {
-		err := c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+		err := c.conn.SetReadDeadline(time.Now().Add(c.timeout))
 		if err != nil {
-			log.Debugw("debug|Reply|SetWriteDeadline", "error", err)
-			return err
+			log.Debugw("debug|Reply|SetReadDeadline", "error", err)
+			return nil, err
 		}
 	}
-	log.Info("write data")
-	_, err = c.conn.Write(resp.JSON())
+	log.Info("read data")
+	n, err := c.conn.Read(data)
 	if err != nil {
-		log.Debugw("debug|Reply|Write", "error", err)
-		return err
+		return nil, err
 	}
-	return nil
+	return data[:n], nil
 }
 
 func (c *tcpConnector) intermediary() error {
+	data, err := c.request()
+	if err != nil {
+		return err
+	}
+	var r RendezvousRequest
+	err = json.Unmarshal(data, &r)
+	if err != nil {
+		return err
+	}
+	if err := c.identify(r.Peer.ID); err != nil {
+		_ = c.Reply(HandshakeStatusFailed, []byte(err.Error()))
+		return err
+	}
+	r.Peer.Addr = *common.ParseNetAddr(c.conn.RemoteAddr())
+	req, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if !c.callback(HandshakeTypeAdapter, req) {
+		return c.Reply(HandshakeStatusFailed, []byte("rendezvous was not supported"))
+	}
 	return nil
 }
 
+// relay hands the connection over to the relay of the subject
+func (c *tcpConnector) relay() error {
+	data, err := c.request()
+	if err != nil {
+		return err
+	}
+	var r RendezvousRequest
+	err = json.Unmarshal(data, &r)
+	if err != nil {
+		return err
+	}
+	if err := c.identify(r.Peer.ID); err != nil {
+		_ = c.Reply(HandshakeStatusFailed, []byte(err.Error()))
+		return err
+	}
+	r.Peer.Addr = *common.ParseNetAddr(c.conn.RemoteAddr())
+	req, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	c.hijacked = true
+	c.lock.Unlock()
+	if !c.callback(HandshakeTypeRelay, req) {
+		c.lock.Lock()
+		c.hijacked = false
+		c.lock.Unlock()
+		return c.Reply(HandshakeStatusFailed, []byte("relay was not supported"))
+	}
+	//the connector stays tracked by the listener until the relay closes its connection
+	return errConnectorHijacked
+}
+
+// identify checks the id claimed in the handshake against the client certificate and the authorization
+func (c *tcpConnector) identify(id string) error {
+	if err := verifyID(c.conn, id); err != nil {
+		return err
+	}
+	return c.auth.check(id)
+}
+
+func (c *tcpConnector) authorize() error {
+	data, err := c.request()
+	if err != nil {
+		return err
+	}
+	return authorize(c, c.auth, data)
+}
+
+func (c *tcpConnector) hijack() net.Conn {
+	return &hijackedConn{
+		Conn:      c.conn,
+		connector: c,
+	}
+}
+
+// abort closes the connection even when it was hijacked by the relay
+func (c *tcpConnector) abort() {
+	if err := c.release(); err != nil {
+		log.Debugw("debug|abort|Close", "error", err)
+	}
+}
+
+// release untracks the connector and closes its connection
+func (c *tcpConnector) release() error {
+	if c.closed != nil {
+		c.closed()
+	}
+	c.callClosed()
+	return c.conn.Close()
+}
+
 func (c *tcpConnector) other(ht HandshakeType) error {
 	switch ht {
 	case HandshakeReverse:
@@ -164,6 +285,10 @@ func (c *tcpConnector) pong() error {
 
 // Do ...
 func (c *tcpConnector) Do(ht HandshakeType) error {
+	if !c.auth.authorized(ht) {
+		_ = c.Reply(HandshakeStatusFailed, []byte(errAuthRequired.Error()))
+		return errAuthRequired
+	}
 	switch ht {
 	case HandshakeTypePing:
 		return c.pong()
@@ -171,11 +296,35 @@ func (c *tcpConnector) Do(ht HandshakeType) error {
 		return c.interaction()
 	case HandshakeTypeAdapter:
 		return c.intermediary()
+	case HandshakeTypeRelay:
+		return c.relay()
+	case HandshakeAuthorization:
+		return c.authorize()
 	}
 	return c.other(ht)
 }
 
+// interrupt breaks the wait for the next handshake, the one being handled is finished
+func (c *tcpConnector) interrupt() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stopping = true
+	//the relay keeps its own deadlines
+	if c.hijacked {
+		return
+	}
+	if err := c.conn.SetReadDeadline(time.Now()); err != nil {
+		log.Debugw("debug|interrupt|SetReadDeadline", "error", err)
+	}
+}
+
 // Close ...
 func (c *tcpConnector) Close() error {
-	return c.conn.Close()
+	c.lock.RLock()
+	hijacked := c.hijacked
+	c.lock.RUnlock()
+	if hijacked {
+		return nil
+	}
+	return c.release()
 }
@@ -20,6 +20,9 @@ type tcpListener struct {
 	nat         nat.NAT
 	listener    net.Listener
 	cfg         *Config
+	subject     Subject
+	connectors  connectorSet
+	done        chan struct{}
 	ready       bool
 }
 
@@ -38,6 +41,10 @@ func (l *tcpListener) IsReady() bool {
 	return l.ready
 }
 
+func (l *tcpListener) setSubject(s Subject) {
+	l.subject = s
+}
+
 // MappingPort ...
 func (l *tcpListener) MappingPort() int {
 	return l.mappingPort
@@ -50,6 +57,7 @@ func NewTCPListener(cfg *Config) Listener {
 		cancel: nil,
 		port:   cfg.TCP,
 		cfg:    cfg,
+		done:   make(chan struct{}),
 	}
 	tcp.ctx, tcp.cancel = context.WithCancel(context.TODO())
 	var err error
@@ -69,11 +77,13 @@ func NewTCPListener(cfg *Config) Listener {
 func (l *tcpListener) Listen(c chan<- Connector) (err error) {
 	tcpAddr := common.LocalTCPAddr(l.port)
 	if l.cfg.UseSecret {
-		l.listener, err = reuse.ListenTLS("tcp", DefaultLocalTCPAddr.String(), l.cfg.secret)
+		l.listener, err = listenTLS(l.cfg, tcpAddr.String())
 	} else {
 		l.listener, err = reuse.ListenTCP("tcp", tcpAddr)
 	}
 	if err != nil {
+		//the typed nil of a failed listen is not a nil interface
+		l.listener = nil
 		return err
 	}
 	fmt.Println("listen tcp on address:", tcpAddr.String())
@@ -88,10 +98,26 @@ func (l *tcpListener) Stop() error {
 		l.cancel()
 		l.cancel = nil
 	}
+	if l.listener != nil {
+		return l.listener.Close()
+	}
 	return nil
 }
 
+// Shutdown stops accepting and waits for the connectors being handled until ctx is done
+func (l *tcpListener) Shutdown(ctx context.Context) error {
+	if err := l.Stop(); err != nil {
+		log.Debugw("debug|Shutdown|Stop", "error", err)
+	}
+	if l.listener != nil {
+		<-l.done
+	}
+	defer l.funcPool.Release()
+	return l.connectors.drain(ctx)
+}
+
 func (l *tcpListener) listenTCP(c chan<- Connector) (err error) {
+	defer close(l.done)
 	for {
 		select {
 		case <-l.ctx.Done():
@@ -105,12 +131,27 @@ func (l *tcpListener) listenTCP(c chan<- Connector) (err error) {
 			}
 			log.Debugw("new connector")
 			t := newTCPConnector(conn)
+			t.auth = newAuthorizer(l.cfg.AuthKeys)
+			l.connectors.add(t)
+			t.closed = func() {
+				l.connectors.remove(t)
+			}
+			if l.subject != nil {
+				if err := l.subject.Add(t); err != nil {
+					log.Debugw("debug|subject|Add", "error", err)
+				}
+			}
 			err = l.funcPool.Invoke(t)
 			if err != nil {
 				log.Debugw("debug|funcPool|Invoke", "error", err)
+				t.Close()
 				continue
 			}
-			c <- t
+			select {
+			case c <- t:
+			case <-l.ctx.Done():
+				return nil
+			}
 			log.Debugw("connect done")
 		}
 	}
@@ -121,8 +162,12 @@ func tcpHandler(i interface{}) {
 	if !b {
 		return
 	}
-	err := receive(connector)
-	if err != nil {
-		log.Debugw("tcp handler error", "error", err)
+	defer connector.Close()
+	for {
+		err := receive(connector)
+		if err != nil {
+			log.Debugw("tcp handler error", "error", err)
+			return
+		}
 	}
 }
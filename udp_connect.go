@@ -0,0 +1,238 @@
+package lurker
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/portmapping/lurker/common"
+)
+
+var _ Connector = &udpConnector{}
+
+var errConnectorClosed = errors.New("connector was closed")
+var errConnectorIdle = errors.New("connector was idle")
+
+type udpConnector struct {
+	connectorListener
+	timeout time.Duration
+	idle    time.Duration
+	conn    *net.UDPConn
+	remote  *net.UDPAddr
+	data    chan []byte
+	done    chan struct{}
+	once    sync.Once
+	closed  func()
+	lock    sync.RWMutex
+	head    HandshakeHead
+	payload []byte
+	auth    *authorizer
+}
+
+// ConnectorListener ...
+func (c *udpConnector) ConnectorListener() ConnectorListener {
+	return c
+}
+
+func newUDPConnector(conn *net.UDPConn, remote *net.UDPAddr) *udpConnector {
+	return &udpConnector{
+		timeout: 5 * time.Second,
+		idle:    DefaultTimeout,
+		conn:    conn,
+		remote:  remote,
+		data:    make(chan []byte, 16),
+		done:    make(chan struct{}),
+	}
+}
+
+// push queues a datagram received from the remote peer
+func (c *udpConnector) push(b []byte) {
+	select {
+	case <-c.done:
+	case c.data <- b:
+	default:
+		log.Debugw("debug|udpConnector|push", "dropped", len(b))
+	}
+}
+
+func (c *udpConnector) read(timeout time.Duration) ([]byte, error) {
+	select {
+	case <-c.done:
+		return nil, errConnectorClosed
+	case b := <-c.data:
+		return b, nil
+	case <-time.After(timeout):
+		return nil, errConnectorIdle
+	}
+}
+
+// Header ...
+func (c *udpConnector) Header() (HandshakeHead, error) {
+	b, err := c.read(c.idle)
+	if err != nil {
+		return HandshakeHead{}, err
+	}
+	h, payload, err := DecodeHandshake(b)
+	if err != nil {
+		return HandshakeHead{}, err
+	}
+	c.lock.Lock()
+	c.head, c.payload = h, payload
+	c.lock.Unlock()
+	return h, nil
+}
+
+// Reply ...
+func (c *udpConnector) Reply(status HandshakeStatus, data []byte) error {
+	select {
+	case <-c.done:
+		return errConnectorClosed
+	default:
+	}
+	r := HandshakeResponse{
+		Status: status,
+		Data:   data,
+	}
+	c.lock.RLock()
+	ver := c.head.Version
+	c.lock.RUnlock()
+	resp, err := EncodeHandshakeResponse(ver, &r)
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.WriteToUDP(resp, c.remote)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *udpConnector) interaction() (err error) {
+	log.Debugw("interaction call")
+	data, err := c.request()
+	if err != nil {
+		log.Debugw("debug|udpConnector|read", "error", err)
+		return err
+	}
+
+	var r HandshakeRequest
+	service, err := DecodeHandshakeRequest(data, &r)
+	if err != nil {
+		log.Debugw("debug|udpConnector|DecodeHandshakeRequest", "error", err)
+		return err
+	}
+
+	if err := c.auth.check(service.ID); err != nil {
+		_ = c.Reply(HandshakeStatusFailed, []byte(err.Error()))
+		return err
+	}
+	c.callID(service.ID)
+	netAddr := common.ParseNetAddr(c.remote)
+	log.Debugw("debug|udpConnector|ParseNetAddr", "common", netAddr)
+	c.callAddr(*netAddr)
+	c.callback(HandshakeTypeConnect, Peer{
+		ID:      service.ID,
+		Addr:    *netAddr,
+		Service: service,
+	}.JSON())
+	return c.Reply(HandshakeStatusSuccess, []byte("Connected"))
+}
+
+// request returns the payload of the current handshake,
+// Version1 peers send it in the next datagram
+func (c *udpConnector) request() ([]byte, error) {
+	if c.head.Version.IsFramed() {
+		return c.payload, nil
+	}
+	return c.read(c.timeout)
+}
+
+func (c *udpConnector) intermediary() error {
+	data, err := c.request()
+	if err != nil {
+		return err
+	}
+	var r RendezvousRequest
+	err = json.Unmarshal(data, &r)
+	if err != nil {
+		return err
+	}
+	if err := c.auth.check(r.Peer.ID); err != nil {
+		_ = c.Reply(HandshakeStatusFailed, []byte(err.Error()))
+		return err
+	}
+	r.Peer.Addr = *common.ParseNetAddr(c.remote)
+	req, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if !c.callback(HandshakeTypeAdapter, req) {
+		return c.Reply(HandshakeStatusFailed, []byte("rendezvous was not supported"))
+	}
+	return nil
+}
+
+func (c *udpConnector) other(ht HandshakeType) error {
+	switch ht {
+	case HandshakeReverse:
+		dial, err := net.DialUDP("udp", nil, c.remote)
+		if err != nil {
+			return err
+		}
+		defer dial.Close()
+		resp, err := EncodeHandshakeResponse(c.head.Version, &HandshakeResponse{
+			Status: HandshakeStatusSuccess,
+			Data:   []byte("PONG"),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = dial.Write(resp)
+		return err
+	case HandshakeTypeRelay:
+		return c.Reply(HandshakeStatusFailed, []byte("relay was not supported on udp"))
+	}
+	return nil
+}
+
+// Pong ...
+func (c *udpConnector) pong() error {
+	return c.Reply(HandshakeStatusSuccess, []byte("PONG"))
+}
+
+// Do ...
+func (c *udpConnector) Do(ht HandshakeType) error {
+	if !c.auth.authorized(ht) {
+		_ = c.Reply(HandshakeStatusFailed, []byte(errAuthRequired.Error()))
+		return errAuthRequired
+	}
+	switch ht {
+	case HandshakeTypePing:
+		return c.pong()
+	case HandshakeTypeConnect:
+		return c.interaction()
+	case HandshakeTypeAdapter:
+		return c.intermediary()
+	case HandshakeAuthorization:
+		data, err := c.request()
+		if err != nil {
+			return err
+		}
+		return authorize(c, c.auth, data)
+	}
+	return c.other(ht)
+}
+
+// Close ...
+func (c *udpConnector) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		if c.closed != nil {
+			c.closed()
+		}
+		c.callClosed()
+	})
+	return nil
+}
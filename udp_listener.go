@@ -4,28 +4,50 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sync"
 
+	"github.com/panjf2000/ants/v2"
+	"github.com/portmapping/go-reuse"
 	"github.com/portmapping/lurker/common"
 	"github.com/portmapping/lurker/nat"
+	"github.com/portmapping/lurker/stun"
 )
 
 type udpListener struct {
 	ctx         context.Context
 	cancel      context.CancelFunc
+	funcPool    *ants.PoolWithFunc
 	port        int
 	mappingPort int
 	nat         nat.NAT
-	listener    net.Listener
 	udpListener *net.UDPConn
+	stun        *stun.Server
+	connectors  sync.Map
 	cfg         *Config
+	subject     Subject
+	done        chan struct{}
 	ready       bool
 }
 
+// IsSupport ...
+func (l *udpListener) IsSupport() bool {
+	return l.cfg.NAT && l.nat != nil
+}
+
+// NAT ...
+func (l *udpListener) NAT() nat.NAT {
+	return l.nat
+}
+
 // IsReady ...
 func (l *udpListener) IsReady() bool {
 	return l.ready
 }
 
+func (l *udpListener) setSubject(s Subject) {
+	l.subject = s
+}
+
 // MappingPort ...
 func (l *udpListener) MappingPort() int {
 	return l.mappingPort
@@ -37,6 +59,27 @@ func (l *udpListener) Stop() error {
 		l.cancel()
 		l.cancel = nil
 	}
+	if l.udpListener == nil {
+		return nil
+	}
+	l.stun.Close()
+	return l.udpListener.Close()
+}
+
+// Shutdown closes the socket and the connectors, a udp connector only waits
+// for datagrams which can not arrive any more
+func (l *udpListener) Shutdown(ctx context.Context) error {
+	if err := l.Stop(); err != nil {
+		log.Debugw("debug|Shutdown|Stop", "error", err)
+	}
+	if l.udpListener != nil {
+		<-l.done
+	}
+	l.connectors.Range(func(key, value interface{}) bool {
+		value.(*udpConnector).Close()
+		return true
+	})
+	l.funcPool.Release()
 	return nil
 }
 
@@ -47,156 +90,115 @@ func NewUDPListener(cfg *Config) Listener {
 		cancel: nil,
 		cfg:    cfg,
 		port:   cfg.UDP,
+		done:   make(chan struct{}),
 	}
 	udp.ctx, udp.cancel = context.WithCancel(context.TODO())
+	var err error
+	if cfg.NAT {
+		udp.nat, err = Mapping("udp", cfg.UDP)
+		if err != nil {
+			panic(err)
+		}
+	}
+	udp.funcPool, err = ants.NewPoolWithFunc(ants.DefaultAntsPoolSize, udpHandler, func(opts *ants.Options) {
+		opts.Nonblocking = false
+	})
 	return udp
 }
 
 // Listen ...
 func (l *udpListener) Listen(c chan<- Connector) (err error) {
 	udpAddr := common.LocalUDPAddr(l.port)
-	//l.listener, err = kcp.Listen(udpAddr.String())
-	//if err != nil {
-	//	return err
-	//}
-	l.udpListener, err = net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		return err
-	}
-	fmt.Println("listen udp on common:", udpAddr.String())
-	go listenUDP(l.ctx, l.udpListener, c)
-
-	if !l.cfg.NAT {
-		return nil
+	alternate := net.ParseIP(l.cfg.AlternateIP)
+	if alternate != nil && l.cfg.AlternatePort != 0 {
+		//the alternate ip is bound on the same port
+		conn, err := reuse.ListenPacket("udp", udpAddr.String())
+		if err != nil {
+			return err
+		}
+		l.udpListener = conn.(*net.UDPConn)
+	} else {
+		l.udpListener, err = net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			return err
+		}
 	}
-	l.nat, err = Mapping("udp", l.cfg.UDP)
+	l.stun, err = stun.NewServer(l.udpListener, alternate, l.cfg.AlternatePort)
 	if err != nil {
+		l.udpListener.Close()
+		l.udpListener = nil
 		return err
 	}
+	fmt.Println("listen udp on common:", udpAddr.String())
+	go l.listenUDP(c)
 	l.ready = true
 	return nil
 }
 
-type udpHandshake struct {
-	conn     *net.UDPConn
-	addr     *net.UDPAddr
-	connBack func(f Connector)
-}
-
-// Intermediary ...
-func (h *udpHandshake) Intermediary() error {
-	panic("implement me")
-}
-
-// Interaction ...
-func (h *udpHandshake) Interaction() error {
-	panic("implement me")
-}
-
-// Other ...
-func (h *udpHandshake) Other() error {
-	panic("implement me")
-}
-
-// Pong ...
-func (h *udpHandshake) Pong() error {
-	response := HandshakeResponse{
-		Status: HandshakeStatusSuccess,
-		Data:   []byte("PONG"),
-	}
-	write, err := h.conn.WriteToUDP(response.JSON(), h.addr)
-	if err != nil {
-		return err
-	}
-	if write == 0 {
-		log.Warnw("write pong", "written", 0)
-	}
-	return nil
-}
-
-// Reply ...
-func (h *udpHandshake) Reply() error {
+func (l *udpListener) listenUDP(c chan<- Connector) {
+	defer close(l.done)
 	data := make([]byte, maxByteSize)
-	n, addr, err := h.conn.ReadFromUDP(data)
-	if err != nil {
-		log.Debugw("debug|getClientFromTCP|Read", "error", err)
-		return err
-	}
-	//ip, port := ParseAddr(common.String())
-	//var r HandshakeRequest
-	//service, err := DecodeHandshakeRequest(data[:n], &r)
-	//if err != nil {
-	//	log.Debugw("debug|getClientFromTCP|ParseService", "error", err)
-	//	return err
-	//}
-
-	//c := source{
-	//	common: Addr{
-	//		Protocol: h.common.Network(),
-	//		IP:       ip,
-	//		Port:     port,
-	//	},
-	//	service: service,
-	//}
-	//h.connBack(&c)
-	//todo:udpConnector
-	_ = n
-
-	netAddr := common.ParseNetAddr(h.addr)
-	log.Debugw("debug|getClientFromTCP|ParseNetAddr", netAddr)
-	var resp HandshakeResponse
-	resp.Status = HandshakeStatusSuccess
-	resp.Data = []byte("Connected")
-	_, err = h.conn.WriteToUDP(resp.JSON(), addr)
-	if err != nil {
-		log.Debugw("debug|getClientFromTCP|write", "error", err)
-		return err
-	}
-	return nil
-}
-
-// ConnectCallback ...
-func (h *udpHandshake) ConnectCallback(f func(f Connector)) {
-	h.connBack = f
-}
-
-// Do ...
-func (h *udpHandshake) Do() (err error) {
-	data := make([]byte, maxByteSize)
-	var n int
-	n, h.addr, err = h.conn.ReadFromUDP(data)
-	if err != nil {
-		//waiting for next
-		log.Debugw("debug|listenUDP|ReadFromUDP", "error", err)
-		return err
-	}
-	log.Debugw("received", "data", string(data[:n]))
-	handshake, err := ParseHandshakeByte(data[:n])
-	if err != nil {
-		return err
-	}
-	return handshake.Run(h)
-}
-
-func listenUDP(ctx context.Context, listener *net.UDPConn, cli chan<- Connector) (err error) {
-
 	for {
 		select {
-		case <-ctx.Done():
+		case <-l.ctx.Done():
+			log.Debugw("context done")
 			return
 		default:
-			u := udpHandshake{
-				conn: listener,
+			n, addr, err := l.udpListener.ReadFromUDP(data)
+			if err != nil {
+				log.Debugw("debug|listenUDP|ReadFromUDP", "error", err)
+				continue
+			}
+			if l.stun.Handle(data[:n], addr) {
+				continue
+			}
+			b := make([]byte, n)
+			copy(b, data[:n])
+			key := addr.String()
+			if v, b2 := l.connectors.Load(key); b2 {
+				v.(*udpConnector).push(b)
+				continue
 			}
-			u.ConnectCallback(func(f Connector) {
-				cli <- f
-			})
-			err = u.Do()
+			log.Debugw("new connector", "addr", key)
+			t := newUDPConnector(l.udpListener, addr)
+			t.auth = newAuthorizer(l.cfg.AuthKeys)
+			t.closed = func() {
+				l.connectors.Delete(key)
+			}
+			l.connectors.Store(key, t)
+			t.push(b)
+			if l.subject != nil {
+				if err := l.subject.Add(t); err != nil {
+					log.Debugw("debug|subject|Add", "error", err)
+				}
+			}
+			err = l.funcPool.Invoke(t)
 			if err != nil {
+				log.Debugw("debug|funcPool|Invoke", "error", err)
+				t.Close()
 				continue
 			}
+			select {
+			case c <- t:
+			case <-l.ctx.Done():
+				return
+			}
+			log.Debugw("connect done")
+		}
+	}
+}
 
-			return nil
+func udpHandler(i interface{}) {
+	connector, b := i.(Connector)
+	if !b {
+		return
+	}
+	defer connector.Close()
+	for {
+		err := receive(connector)
+		if err != nil {
+			log.Debugw("udp handler error", "error", err)
+			return
 		}
 	}
 }
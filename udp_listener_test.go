@@ -0,0 +1,98 @@
+package lurker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/portmapping/lurker/common"
+	"github.com/portmapping/lurker/stun"
+)
+
+func freeUDPPort(t *testing.T) int {
+	conn, err := net.ListenUDP("udp", common.LocalUDPAddr(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// TestUDPListener_Listen ...
+func TestUDPListener_Listen(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.NAT = false
+	cfg.UDP = freeUDPPort(t)
+	l := NewUDPListener(cfg)
+	c := make(chan Connector, 1)
+	if err := l.Listen(c); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+
+	s := &source{
+		service: Service{ID: "udp-test"},
+		addr:    *common.ParseSourceAddr("udp", net.IPv4(127, 0, 0, 1), cfg.UDP),
+		timeout: 3 * time.Second,
+	}
+	conn, err := net.DialUDP("udp", nil, s.addr.UDP())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := ping(s, conn); err != nil {
+		t.Fatal(err)
+	}
+
+	var connector Connector
+	select {
+	case connector = <-c:
+	case <-time.After(3 * time.Second):
+		t.Fatal("connector was not received")
+	}
+	ids := make(chan string, 1)
+	connector.ConnectorListener().ID(func(id string) {
+		ids <- id
+	})
+
+	if _, err := connect(s, conn); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case id := <-ids:
+		if id != "udp-test" {
+			t.Fatal("wrong id", id)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("id was not received")
+	}
+}
+
+// TestUDPListener_STUN ...
+func TestUDPListener_STUN(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.NAT = false
+	cfg.UDP = freeUDPPort(t)
+	cfg.AlternateIP = "127.0.0.2"
+	cfg.AlternatePort = freeUDPPort(t)
+	l := NewUDPListener(cfg)
+	if err := l.Listen(make(chan Connector, 1)); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := stun.NewClient(common.ParseSourceAddr("udp", net.IPv4(127, 0, 0, 1), cfg.UDP).String())
+	c.Timeout, c.Retransmit = 500*time.Millisecond, 100*time.Millisecond
+	r, err := c.Discover(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.NAT != stun.BehaviorOpen || r.Mapped.Port != conn.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatal("wrong result", r)
+	}
+}
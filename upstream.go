@@ -0,0 +1,53 @@
+package lurker
+
+import (
+	"fmt"
+
+	"github.com/portmapping/lurker/proxy"
+)
+
+// Upstream is a socks5, http or https proxy the connections are chained through
+type Upstream struct {
+	Name string `json:"name" yaml:"name" toml:"name"`
+	Type string `json:"type" yaml:"type" toml:"type"`
+	Addr string `json:"addr" yaml:"addr" toml:"addr"`
+	User string `json:"user" yaml:"user" toml:"user"`
+	Pass string `json:"pass" yaml:"pass" toml:"pass"`
+}
+
+// Dialer returns the dialer of the upstreams and routes, proxy.Direct when none is configured
+func (c *Config) Dialer() (proxy.Dialer, error) {
+	if len(c.Upstreams) == 0 && len(c.Routes) == 0 && c.Upstream == "" {
+		return proxy.Direct, nil
+	}
+	upstreams := make(map[string]proxy.Dialer, len(c.Upstreams))
+	for _, u := range c.Upstreams {
+		if u.Name == "" {
+			return nil, fmt.Errorf("upstream of %v was not named", u.Addr)
+		}
+		if _, b := upstreams[u.Name]; b {
+			return nil, fmt.Errorf("upstream %v was duplicated", u.Name)
+		}
+		var auth *proxy.Auth
+		if u.User != "" {
+			auth = &proxy.Auth{
+				Name: u.User,
+				Pass: u.Pass,
+			}
+		}
+		d, err := proxy.NewUpstream(u.Type, u.Addr, auth, nil, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		upstreams[u.Name] = d
+	}
+	var def proxy.Dialer = proxy.Direct
+	if c.Upstream != "" {
+		d, b := upstreams[c.Upstream]
+		if !b {
+			return nil, fmt.Errorf("upstream %v was not found", c.Upstream)
+		}
+		def = d
+	}
+	return proxy.NewRouter(upstreams, c.Routes, def)
+}
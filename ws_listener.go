@@ -3,11 +3,11 @@ package lurker
 import (
 	"context"
 	"fmt"
-	"github.com/portmapping/go-reuse"
-	"github.com/portmapping/lurker/common"
 	"net"
 	"net/http"
 
+	"github.com/portmapping/go-reuse"
+	"github.com/portmapping/lurker/common"
 	"github.com/portmapping/lurker/nat"
 )
 
@@ -18,6 +18,7 @@ type wsListener struct {
 	mappingPort int
 	nat         nat.NAT
 	listener    net.Listener
+	srv         *http.Server
 	cfg         *Config
 	ready       bool
 	handler     http.Handler
@@ -29,38 +30,53 @@ type wsListener struct {
 func (ws *wsListener) Listen(c chan<- Connector) (err error) {
 	tcpAddr := common.LocalTCPAddr(ws.port)
 	if ws.cfg.UseSecret {
-		ws.listener, err = reuse.ListenTLS("tcp", DefaultLocalTCPAddr.String(), ws.cfg.secret)
-		http.Serve(ws.listener, ws.handler)
+		ws.listener, err = listenTLS(ws.cfg, tcpAddr.String())
 	} else {
-		ws.listener, err = reuse.ListenTCP("tcp", tcpAddr)
-		http.ServeTLS(ws.listener, ws.handler, ws.certFile, ws.keyFile)
+		ws.listener, err = reuse.Listen("tcp", tcpAddr.String())
 	}
 	if err != nil {
 		return err
 	}
+	ws.srv = &http.Server{Handler: ws.handler}
 	fmt.Println("listen tcp on address:", tcpAddr.String())
+	go func() {
+		if err := ws.srv.Serve(ws.listener); err != nil {
+			log.Debugw("debug|wsListener|Serve", "error", err)
+		}
+	}()
 	ws.ready = true
 	return
 }
 
 // Stop ...
 func (ws *wsListener) Stop() error {
-	panic("implement me")
+	if ws.srv != nil {
+		return ws.srv.Close()
+	}
+	return nil
+}
+
+// Shutdown waits for the active requests until ctx is done
+func (ws *wsListener) Shutdown(ctx context.Context) error {
+	if ws.srv != nil {
+		return ws.srv.Shutdown(ctx)
+	}
+	return nil
 }
 
 // IsReady ...
 func (ws *wsListener) IsReady() bool {
-	panic("implement me")
+	return ws.ready
 }
 
 // IsSupport ...
 func (ws *wsListener) IsSupport() bool {
-	panic("implement me")
+	return ws.cfg.NAT && ws.nat != nil
 }
 
 // NAT ...
 func (ws *wsListener) NAT() nat.NAT {
-	panic("implement me")
+	return ws.nat
 }
 
 func (ws *wsListener) newHandle() {